@@ -18,324 +18,2343 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"cmp"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
 	"time"
+
+	"github.com/asig/ceres_floppy_tool/oberon"
 )
 
-const (
-	blockSize          = 512
-	maxFilenameLen     = 22
-	fileDescSize       = 32
-	dirEntriesPerBlock = blockSize / fileDescSize
+type command func() error
+
+var (
+	errReadOnlyStdin  = errors.New("images read from stdin can't be modified")
+	errUnknownCommand = errors.New("unknown command")
 )
 
-// ---------------------------------
-// fileDesc
-// ---------------------------------
+// config holds the default flags read from the config file. The keys are
+// the command names, and "global" for the flags before the image file.
+var config map[string][]string
 
-type fileDesc struct {
-	name       [maxFilenameLen]byte
-	time, date int16
-	head       int16
-	size       int32
+// loadConfig reads the default flags from filename, a JSON object such as
+// {"global": ["-tz", "UTC"], "extract": ["-o", "extracted"]}. A missing
+// file is only an error if mustExist is set.
+func loadConfig(filename string, mustExist bool) error {
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) && !mustExist {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("invalid config file %s: %w", filename, err)
+	}
+	return nil
 }
 
-func (fd *fileDesc) nameAsString() string {
-	i := 0
-	for i < maxFilenameLen && fd.name[i] != 0 {
-		i++
+// parseFlags parses args with fs, preceded by the command's default flags
+// from the config file, so that args override them.
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	err := fs.Parse(append(slices.Clone(config[fs.Name()]), args...))
+	if errors.Is(err, flag.ErrHelp) {
+		return helpError{fs}
 	}
-	return string(fd.name[:i])
+	return err
 }
 
-func (fd *fileDesc) timestamp() time.Time {
-	// Oberon date and time format, according to "The Oberon System: User Guide and Programmer's Manual" by Martin Reiser
-	// Date: 7 bits year, 4 bits month, 5 bits day
-	// Time: 5 bits hour, 6 bits minute, 6 bits seconds.
-	//
-	// On floppy disks, the lowest bit of seconds is dropped
-
-	y := 1900 + int(fd.date>>9&0x7f)
-	m := time.Month(fd.date >> 5 & 0xf)
-	d := int(fd.date & 0x1f)
-
-	hh := int(fd.time >> 11 & 0x1f)
-	mm := int(fd.time >> 5 & 0x6f)
-	ss := int(fd.time&0x1f) * 2
-
-	loc, _ := time.LoadLocation("Local")
-	return time.Date(y, m, d, hh, mm, ss, 0, loc)
+// helpError is returned by parseFlags if the help of the command whose
+// flags are fs was requested.
+type helpError struct {
+	fs *flag.FlagSet
 }
 
-func fileDescFromBytes(buf []byte, ofs int) fileDesc {
-	base := ofs * fileDescSize
-	var fd fileDesc
-	copy(fd.name[:], buf[base:base+maxFilenameLen])
-	fd.time = int16(buf[base+23])<<8 | int16(buf[base+22])
-	fd.date = int16(buf[base+25])<<8 | int16(buf[base+24])
-	fd.head = int16(buf[base+27])<<8 | int16(buf[base+26])
-	fd.size = int32(buf[base+31])<<24 | int32(buf[base+30])<<16 | int32(buf[base+29])<<8 | int32(buf[base+28])
-
-	return fd
+func (e helpError) Error() string {
+	return "help requested for " + e.fs.Name()
 }
 
-// ---------------------------------
-// floppy
-// ---------------------------------
-
-type floppy struct {
-	img []byte
-	fat [720]int32
-}
+func parseCommandLine(args []string) (cmd command, err error) {
+	configFile, mustExist := "", false
+	if home, err := os.UserHomeDir(); err == nil {
+		configFile = filepath.Join(home, ".cftrc")
+	}
+	if len(args) > 1 && args[0] == "-config" {
+		configFile, mustExist = args[1], true
+		args = args[2:]
+	}
+	if configFile != "" {
+		if err := loadConfig(configFile, mustExist); err != nil {
+			return nil, err
+		}
+	}
+	args = append(slices.Clone(config["global"]), args...)
 
-func (fl *floppy) getBlocks(idx, cnt int32) []byte {
-	ofs := idx * blockSize
-	return fl.img[ofs : ofs+cnt*blockSize]
+	open := oberon.Open
+	setup := floppySetup{dirStart: -1, dirEnd: -1}
+	for len(args) > 0 && slices.Contains([]string{"-v", "-tz", "-mmap", "-strict", "-ignore-label", "-any-media", "-dir-start", "-dir-end"}, args[0]) {
+		switch args[0] {
+		case "-ignore-label":
+			setup.ignoreLabel = true
+			args = args[1:]
+		case "-any-media":
+			setup.anyMedia = true
+			args = args[1:]
+		case "-dir-start", "-dir-end":
+			if len(args) < 2 {
+				return nil, errors.New("block missing")
+			}
+			n, err := strconv.Atoi(args[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid block %q", args[1])
+			}
+			if args[0] == "-dir-start" {
+				setup.dirStart = n
+			} else {
+				setup.dirEnd = n
+			}
+			args = args[2:]
+		case "-strict":
+			setup.strict = true
+			args = args[1:]
+		case "-v":
+			oberon.SetLogOutput(os.Stderr)
+			args = args[1:]
+		case "-mmap":
+			open = oberon.OpenMapped
+			args = args[1:]
+		case "-tz":
+			if len(args) < 2 {
+				return nil, errors.New("time zone missing")
+			}
+			loc, err := time.LoadLocation(args[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid time zone %q: %w", args[1], err)
+			}
+			oberon.SetLocation(loc)
+			args = args[2:]
+		}
+	}
+	if len(args) == 0 {
+		return printUsage, nil
+	}
+	if args[0] == "-images" {
+		return parseMultiImageCommandLine(args[1:], open, setup)
+	}
+	if args[0] == "batch" {
+		return parseBatchCommandLine(args[1:], open, setup)
+	}
+	if args[0] == "diff" {
+		return parseDiffCommandLine(args[1:], open, setup)
+	}
+	imageFile := args[0]
+	floppy, err := open(imageFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := setup.apply(floppy); err != nil {
+		return nil, err
+	}
+	command, err := parseCommand(floppy, imageFile, open, setup, args)
+	if err != nil {
+		return nil, err
+	}
+	return setup.wrap(floppy, command), nil
 }
 
-func (fl *floppy) getBlock(idx int32) []byte {
-	return fl.getBlocks(idx, 1)
+// floppySetup holds the global flags that change how floppies are read.
+// They apply to every floppy a command line names, including those of
+// batch, -images and diff.
+type floppySetup struct {
+	strict      bool
+	ignoreLabel bool
+	anyMedia    bool
+	dirStart    int // -1 if not given
+	dirEnd      int // -1 if not given
 }
 
-func (fl *floppy) readDirBlock(block int32) []fileDesc {
-	buf := fl.getBlock(block)
-	var res []fileDesc
-	for i := 0; i < dirEntriesPerBlock; i++ {
-		res = append(res, fileDescFromBytes(buf, i))
+// apply prepares floppy for reading according to the flags. Bypassed
+// checks are only reported as warnings.
+func (s floppySetup) apply(floppy *oberon.Floppy) error {
+	if s.dirStart >= 0 || s.dirEnd >= 0 {
+		first, count := floppy.DirLocation()
+		dirStart, dirEnd := s.dirStart, s.dirEnd
+		if dirStart < 0 {
+			dirStart = int(first)
+		}
+		if dirEnd < 0 {
+			dirEnd = int(first + count)
+		}
+		if err := floppy.SetDirLocation(int32(dirStart), int32(dirEnd)); err != nil {
+			return err
+		}
 	}
-	return res
-}
-
-func (fl *floppy) initFAT() {
-	buf := fl.getBlocks(1, 3)
-	fl.fat[0] = -1
-	fl.fat[1] = -1
-
-	i := 2
-	j := 3
-	for i < 720 {
-		n := int32(buf[j+2])<<16 | int32(buf[j+1])<<8 | int32(buf[j])
-		n0 := n % 4096
-		if n0 > 2047 {
-			n0 -= 4096
+	if s.anyMedia {
+		if err := floppy.IgnoreMediaDescriptor(); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: media descriptor check bypassed: %v\n", err)
 		}
-		n1 := n / 4096
-		if n1 > 2047 {
-			n1 -= 4096
+	}
+	if s.ignoreLabel {
+		if err := floppy.IgnoreVolumeLabel(); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: volume label check bypassed: %v\n", err)
 		}
-		fl.fat[i] = n0
-		fl.fat[i+1] = n1
-		i += 2
-		j += 3
 	}
+	return nil
 }
 
-func (fl *floppy) listFiles() ([]fileDesc, error) {
-	// read boot sector
-	buf := fl.getBlock(0)
-	if buf[21] != 0xf9 && buf[21] != 0xe9 {
-		return nil, errors.New("Neither Oberon nor MSDOS formatted diskette")
+// check runs the strict check of floppy if -strict was given.
+func (s floppySetup) check(floppy *oberon.Floppy) error {
+	if !s.strict {
+		return nil
 	}
+	return floppy.StrictCheck()
+}
 
-	// Read volume label
-	dbuf := fl.readDirBlock(7)
-	fd := dbuf[0]
-	if fd.name[11] != 8 {
-		return nil, errors.New("Block 7 does not contain a valid volume label")
+// open opens imageFile with open, and applies and checks the flags. It is
+// used by the commands that work on several images, which open them only
+// when they are run.
+func (s floppySetup) open(open func(string) (*oberon.Floppy, error), imageFile string) (*oberon.Floppy, error) {
+	floppy, err := open(imageFile)
+	if err != nil {
+		return nil, err
 	}
-	if fd.name[0] < 0xe5 && fd.name[0] != 0 {
-		return nil, errors.New("Not Oberon format")
+	err = s.apply(floppy)
+	if err == nil {
+		err = s.check(floppy)
 	}
+	if err != nil {
+		floppy.Close()
+		return nil, err
+	}
+	return floppy, nil
+}
 
-	var res []fileDesc
-
-	// read directory
-	s := int32(7) // cur block
-	j := 1        // index var in current block
-	for {
-		if dbuf[j].name[0] == 0 || dbuf[j].name[0] == 0xe5 {
-			break
-		}
-
-		res = append(res, dbuf[j])
-
-		j++
-		if j == dirEntriesPerBlock {
-			s++
-			j = 0
-			if s == 14 {
-				break
-			}
-			dbuf = fl.readDirBlock(s)
+// wrap returns cmd, preceded by the strict check of floppy if -strict was
+// given.
+func (s floppySetup) wrap(floppy *oberon.Floppy, cmd command) command {
+	if !s.strict {
+		return cmd
+	}
+	return func() error {
+		if err := s.check(floppy); err != nil {
+			return err
 		}
+		return cmd()
 	}
-
-	return res, nil
 }
 
-func (fl *floppy) readFile(fd fileDesc) ([]byte, error) {
-	var res []byte
-	var buf []byte
-
-	remaining := fd.size
-	if remaining == 0 {
-		return res, nil
+// parseCommand parses the command for floppy, which was opened from
+// imageFile. args[0] is the image file, args[1] the command. If -help is
+// among the command's flags, or is its first parameter if it has no flags,
+// the command prints its help instead.
+func parseCommand(floppy *oberon.Floppy, imageFile string, open func(string) (*oberon.Floppy, error), setup floppySetup, args []string) (cmd command, err error) {
+	cmd, err = parseCommandArgs(floppy, imageFile, open, setup, args)
+	// Parsing the flags fails with the flag set, whose flags are part of
+	// the help.
+	var he helpError
+	if errors.As(err, &he) {
+		name := commandName(args[1])
+		if _, found := commandHelp[name]; found {
+			command := func() error {
+				return printCommandHelp(name, he.fs)
+			}
+			return command, nil
+		}
 	}
-
-	i := int32(fd.head)
-	buf = fl.getBlocks(10+2*i, 2)
-	for remaining > 1024 {
-		res = append(res, buf...)
-		remaining -= 1024
-		i = fl.fat[i]
-		buf = fl.getBlocks(10+2*i, 2)
+	if len(args) > 2 && isHelpFlag(args[1], args[2]) {
+		name := commandName(args[1])
+		if _, found := commandHelp[name]; found {
+			command := func() error {
+				return printCommandHelp(name, nil)
+			}
+			return command, nil
+		}
 	}
-	res = append(res, buf[0:remaining]...)
-
-	return res, nil
+	return cmd, err
 }
 
-func newFloppy(filename string) *floppy {
-	img, err := os.ReadFile(filename)
-	if err != nil {
-		panic(err)
+// isHelpFlag reports whether arg asks for the help of command. -h only
+// does so if the command doesn't use it for something else.
+func isHelpFlag(command, arg string) bool {
+	switch arg {
+	case "-help", "--help":
+		return true
+	case "-h":
+		return commandName(command) != "list"
 	}
-	fl := &floppy{img: img}
-	fl.initFAT()
-	return fl
+	return false
 }
 
-// ------------------------------------------
-
-type command func() error
-
-func parseCommandLine(args []string) (cmd command, err error) {
-	if len(args) == 0 {
-		return printUsage, nil
+func parseCommandArgs(floppy *oberon.Floppy, imageFile string, open func(string) (*oberon.Floppy, error), setup floppySetup, args []string) (cmd command, err error) {
+	if len(args) < 2 {
+		return nil, errors.New("command missing")
 	}
-	imageFile := args[0]
-	floppy := newFloppy(imageFile)
 	i := 1
 	switch args[i] {
 	case "l", "list":
 		// List command
 		i++
+		fs := newFlagSet("list")
+		asJSON := fs.Bool("json", false, "print the listing as JSON")
+		long := fs.Bool("l", false, "also print the head block and the length of the FAT chain")
+		quiet := fs.Bool("q", false, "only print the file names")
+		noSummary := fs.Bool("no-summary", false, "don't print the summary after the files")
+		deleted := fs.Bool("deleted", false, "list the deleted files instead")
+		format := fs.String("format", "", "print every file with the template `tmpl`")
+		sortBy := fs.String("sort", "", "sort the files by `key` (name, size or date)")
+		reverse := fs.Bool("reverse", false, "reverse the order of the files")
+		human := fs.Bool("h", false, "print sizes in human readable units")
+		limit := fs.Int("limit", 0, "only print the first `n` files")
+		epoch := fs.Bool("epoch", false, "print timestamps as Unix epoch seconds")
+		sinceFlag := fs.String("since", "", "only print the files modified at or after `date` (YYYY-MM-DD or RFC 3339)")
+		if err := parseFlags(fs, args[i:]); err != nil {
+			return nil, err
+		}
+		if fs.NArg() > 0 {
+			return nil, errors.New("unexpected args")
+		}
+		if *limit < 0 {
+			return nil, fmt.Errorf("invalid limit %d", *limit)
+		}
+		var since time.Time
+		if *sinceFlag != "" {
+			var err error
+			since, err = parseDate(*sinceFlag)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if !slices.Contains([]string{"", "name", "size", "date"}, *sortBy) {
+			return nil, fmt.Errorf("invalid sort key %q", *sortBy)
+		}
+		var tmpl *template.Template
+		if *format != "" {
+			var err error
+			tmpl, err = template.New("format").Parse(strings.NewReplacer(`\t`, "\t", `\n`, "\n").Replace(*format))
+			if err != nil {
+				return nil, fmt.Errorf("invalid format: %w", err)
+			}
+		}
+		command := func() error {
+			if *deleted {
+				return listDeletedFiles(floppy)
+			}
+			fds, err := floppy.ListFiles()
+			if err != nil {
+				return err
+			}
+			if len(fds) >= floppy.MaxFiles() {
+				fmt.Fprintf(os.Stderr, "Warning: the directory is full, entries after its last block would be ignored\n")
+			}
+			order := sortOrder(fds, *sortBy, *reverse)
+			if !since.IsZero() {
+				order = slices.DeleteFunc(order, func(idx int) bool { return fds[idx].Timestamp().Before(since) })
+			}
+			if *limit > 0 && *limit < len(order) {
+				order = order[:*limit]
+			}
+			sorted := make([]oberon.FileDesc, len(order))
+			for k, idx := range order {
+				sorted[k] = fds[idx]
+			}
+			if *asJSON {
+				return printJSONListing(sorted)
+			}
+			if tmpl != nil {
+				return printFormattedListing(sorted, tmpl)
+			}
+			if *quiet {
+				for _, fd := range sorted {
+					fmt.Println(fd.Name())
+				}
+				return nil
+			}
+			label, err := floppy.VolumeLabel()
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Volume: %s\n", displayLabel(label))
+			unprintable := 0
+			for k, fd := range sorted {
+				if !fd.PrintableName() {
+					unprintable++
+				}
+				size := strconv.Itoa(int(fd.Size()))
+				if *human {
+					size = humanSize(fd.Size())
+				}
+				ts := fd.Timestamp().Format(time.DateTime)
+				if *epoch {
+					ts = strconv.FormatInt(fd.Timestamp().Unix(), 10)
+				}
+				if *long {
+					blocks := "?"
+					if chain, err := floppy.Chain(fd); err == nil {
+						blocks = strconv.Itoa(len(chain))
+					}
+					fmt.Printf("%3d  %5s  %s  %4d  %4s  %-23s\n", order[k]+1, size, ts, fd.Head(), blocks, fd.DisplayName())
+					continue
+				}
+				fmt.Printf("%5s  %s  %-23s\n", size, ts, fd.DisplayName())
+			}
+			if unprintable > 0 {
+				fmt.Fprintf(os.Stderr, "Warning: %d file names contain non-printable characters, the entries might be corrupt\n", unprintable)
+			}
+			if !*noSummary {
+				freeEntries, err := floppy.FreeDirEntries()
+				if err != nil {
+					return err
+				}
+				fmt.Printf("%d files, %d blocks used, %d blocks free, %d directory entries free\n",
+					len(fds), floppy.UsedBlocks(), floppy.FreeBlocks(), freeEntries)
+			}
+			return nil
+		}
+		return command, nil
+	case "find":
+		i++
+		if i >= len(args) {
+			return nil, errors.New("substring missing")
+		}
+		substr := strings.ToLower(args[i])
+		i++
 		if i < len(args) {
 			return nil, errors.New("unexpected args")
 		}
 		command := func() error {
-			fds, err := floppy.listFiles()
+			fds, err := floppy.ListFiles()
 			if err != nil {
 				return err
 			}
 			for _, fd := range fds {
-				fmt.Printf("%5d  %s  %-23s\n", fd.size, fd.timestamp().Format(time.DateTime), fd.nameAsString())
+				if strings.Contains(strings.ToLower(fd.Name()), substr) {
+					fmt.Printf("%5d  %s  %-23s\n", fd.Size(), fd.Timestamp().Format(time.DateTime), fd.DisplayName())
+				}
 			}
 			return nil
 		}
 		return command, nil
+	case "csv":
+		i++
+		if i < len(args) {
+			return nil, errors.New("unexpected args")
+		}
+		command := func() error {
+			fds, err := floppy.ListFiles()
+			if err != nil {
+				return err
+			}
+			return printCSVListing(fds)
+		}
+		return command, nil
 	case "d", "dump":
 		// dump command
 		i++
-		if i >= len(args) {
+		fs := newFlagSet("dump")
+		raw := fs.Bool("raw", false, "include the slack space after the end of the file")
+		text := fs.Bool("text", false, "convert Oberon text to UTF-8")
+		report := fs.Bool("report", false, "report the changes made by -text to stderr")
+		ignoreCase := fs.Bool("i", false, "ignore case when matching the file name")
+		sep := fs.String("sep", "", "write `sep` between the files")
+		if err := parseFlags(fs, args[i:]); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
 			return nil, errors.New("filename missing")
 		}
-		toExtract := args[i]
-		i++
-		if i < len(args) {
+		pattern := fs.Arg(0)
+		if fs.NArg() > 1 {
 			return nil, errors.New("unexpected args")
 		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q", pattern)
+		}
+		separator := strings.NewReplacer(`\t`, "\t", `\n`, "\n").Replace(*sep)
 		command := func() error {
-			fds, err := floppy.listFiles()
+			fds, err := floppy.ListFiles()
 			if err != nil {
 				return err
 			}
-			for _, fd := range fds {
-				if fd.nameAsString() != toExtract {
-					continue
+			matches := matchFiles(fds, pattern, *ignoreCase)
+			if len(matches) == 0 {
+				return fmt.Errorf("%w: %q", oberon.ErrFileNotFound, pattern)
+			}
+			for k, fd := range matches {
+				if k > 0 {
+					io.WriteString(os.Stdout, separator)
 				}
-				data, err := floppy.readFile(fd)
-				if err != nil {
-					return err
+				if err := dumpFile(floppy, fd, *raw, *text, *report); err != nil {
+					return fmt.Errorf("%s: %w", fd.Name(), err)
 				}
-				os.Stdout.Write(data)
-				return nil
 			}
-			return fmt.Errorf("File %q not found", toExtract)
+			return nil
 		}
 		return command, nil
 	case "x", "extract":
 		// extract command
 		i++
-		if i >= len(args) {
+		fs := newFlagSet("extract")
+		var opts extractOptions
+		opts.addFlags(fs)
+		ignoreCase := fs.Bool("i", false, "ignore case when matching the file name")
+		if err := parseFlags(fs, args[i:]); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
 			return nil, errors.New("filename missing")
 		}
-		toExtract := args[i]
+		patterns := fs.Args()
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid pattern %q", pattern)
+			}
+		}
+		command := func() error {
+			fds, err := floppy.ListFiles()
+			if err != nil {
+				return err
+			}
+			if err := opts.prepare(); err != nil {
+				return err
+			}
+			// Extract as much as possible, and report the problems at the end
+			var failures []error
+			for _, pattern := range patterns {
+				matches := matchFiles(fds, pattern, *ignoreCase)
+				if len(matches) == 0 {
+					failures = append(failures, fmt.Errorf("No file matches %q", pattern))
+					continue
+				}
+				for _, fd := range matches {
+					if _, err := extractFile(floppy, fd, opts); err != nil {
+						failures = append(failures, fmt.Errorf("%s: %w", fd.Name(), err))
+					}
+				}
+			}
+			return extractFailures(failures)
+		}
+		return command, nil
+	case "extract-index":
 		i++
-		if i < len(args) {
+		fs := newFlagSet("extract-index")
+		var opts extractOptions
+		opts.addFlags(fs)
+		if err := parseFlags(fs, args[i:]); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return nil, errors.New("index missing")
+		}
+		if fs.NArg() > 1 {
+			return nil, errors.New("unexpected args")
+		}
+		idx, err := strconv.Atoi(fs.Arg(0))
+		if err != nil {
+			return nil, fmt.Errorf("invalid index %q", fs.Arg(0))
+		}
+		command := func() error {
+			fds, err := floppy.ListFiles()
+			if err != nil {
+				return err
+			}
+			if idx < 1 || idx > len(fds) {
+				return fmt.Errorf("index %d out of range (%d files)", idx, len(fds))
+			}
+			if err := opts.prepare(); err != nil {
+				return err
+			}
+			_, err = extractFile(floppy, fds[idx-1], opts)
+			return err
+		}
+		return command, nil
+	case "get":
+		i++
+		fs := newFlagSet("get")
+		text := fs.Bool("text", false, "convert Oberon text to UTF-8")
+		report := fs.Bool("report", false, "report the changes made by -text to stderr")
+		force := fs.Bool("force", false, "overwrite an existing file")
+		if err := parseFlags(fs, args[i:]); err != nil {
+			return nil, err
+		}
+		if fs.NArg() < 2 {
+			return nil, errors.New("filename missing")
+		}
+		if fs.NArg() > 2 {
+			return nil, errors.New("unexpected args")
+		}
+		name, localPath := fs.Arg(0), fs.Arg(1)
+		command := func() error {
+			fds, err := floppy.ListFiles()
+			if err != nil {
+				return err
+			}
+			k := slices.IndexFunc(fds, func(fd oberon.FileDesc) bool { return fd.Name() == name })
+			if k < 0 {
+				return fmt.Errorf("%w: %q", oberon.ErrFileNotFound, name)
+			}
+			if _, err := os.Stat(localPath); err == nil && !*force {
+				return fmt.Errorf("%s exists already", localPath)
+			}
+			data, err := floppy.ReadFile(fds[k])
+			if err != nil {
+				return err
+			}
+			if *text {
+				data = convertText(fds[k], data, *report)
+			}
+			return writeFile(localPath, data, fds[k])
+		}
+		return command, nil
+	case "xa", "extractall":
+		i++
+		fs := newFlagSet("extractall")
+		var opts extractOptions
+		opts.addFlags(fs)
+		quiet := fs.Bool("q", false, "don't print the progress")
+		manifest := fs.Bool("manifest", false, "also write manifest.json describing the files")
+		fs.BoolVar(&opts.splitDots, "split-dots", false, "write the files to subdirectories named after the part of their names before the first dot")
+		if err := parseFlags(fs, args[i:]); err != nil {
+			return nil, err
+		}
+		if fs.NArg() > 0 {
+			return nil, errors.New("unexpected args")
+		}
+		command := func() error {
+			fds, err := floppy.ListFiles()
+			if err != nil {
+				return err
+			}
+			if err := opts.prepare(); err != nil {
+				return err
+			}
+			// Extract as much as possible, and report the problems at the end
+			var failures []error
+			var written []extractedFile
+			for k, fd := range fds {
+				if !*quiet && !opts.dryRun {
+					fmt.Fprintf(os.Stderr, "[%d/%d] extracting %s\n", k+1, len(fds), fd.Name())
+				}
+				file, err := extractFile(floppy, fd, opts)
+				if err != nil {
+					failures = append(failures, fmt.Errorf("%s: %w", fd.Name(), err))
+				}
+				if file != "" {
+					written = append(written, extractedFile{fd, file})
+				}
+			}
+			if *manifest && !opts.dryRun {
+				if err := writeManifest(floppy, written, filepath.Join(opts.outDir, "manifest.json")); err != nil {
+					return err
+				}
+			}
+			return extractFailures(failures)
+		}
+		return command, nil
+	case "hexdump":
+		i++
+		fs := newFlagSet("hexdump")
+		raw := fs.Bool("raw", false, "include the slack space after the end of the file")
+		if err := parseFlags(fs, args[i:]); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return nil, errors.New("filename missing")
+		}
+		name := fs.Arg(0)
+		if fs.NArg() > 1 {
 			return nil, errors.New("unexpected args")
 		}
 		command := func() error {
-			fds, err := floppy.listFiles()
+			fds, err := floppy.ListFiles()
 			if err != nil {
 				return err
 			}
 			for _, fd := range fds {
-				if fd.nameAsString() != toExtract {
+				if fd.Name() != name {
 					continue
 				}
-				extractFile(floppy, fd)
-				return nil
+				read := floppy.ReadFile
+				if *raw {
+					read = floppy.ReadFileRaw
+				}
+				data, err := read(fd)
+				if err != nil {
+					return err
+				}
+				// Same format as hexdump -C
+				d := hex.Dumper(os.Stdout)
+				d.Write(data)
+				return d.Close()
 			}
-			return fmt.Errorf("File %q not found", toExtract)
+			return fmt.Errorf("%w: %q", oberon.ErrFileNotFound, name)
 		}
 		return command, nil
-	case "xa", "extractall":
+	case "raw":
+		i++
+		if i >= len(args) {
+			return nil, errors.New("region missing")
+		}
+		region := args[i]
 		i++
 		if i < len(args) {
 			return nil, errors.New("unexpected args")
 		}
 		command := func() error {
-			fds, err := floppy.listFiles()
+			var first, count int32
+			switch region {
+			case "boot":
+				first, count = 0, 1
+			case "fat":
+				first, count = floppy.FATLocation()
+			case "dir":
+				first, count = floppy.DirLocation()
+			default:
+				n, err := strconv.Atoi(region)
+				if err != nil {
+					return fmt.Errorf("invalid region %q", region)
+				}
+				first, count = int32(n), 1
+			}
+			data, err := floppy.Blocks(first, count)
 			if err != nil {
 				return err
 			}
-			for _, fd := range fds {
-				extractFile(floppy, fd)
-			}
+			os.Stdout.Write(data)
 			return nil
 		}
 		return command, nil
-	default:
-		return nil, errors.New("unknown command")
-	}
-}
-
-func extractFile(fl *floppy, fd fileDesc) error {
-	data, err := fl.readFile(fd)
-	if err != nil {
-		return err
-	}
-	destName := fd.nameAsString()
-	err = os.WriteFile(destName, data, 0666)
-	if err != nil {
-		return err
-	}
-
-	ts := fd.timestamp()
-	err = os.Chtimes(destName, ts, ts)
-	return err
-}
-
-func printUsage() error {
-	fmt.Printf("Usage: cft <image file> command [command params]\n")
-	fmt.Printf("Available commands are: (short form in parentheses)\n")
-	fmt.Printf("  list (l): List all files\n")
-	fmt.Printf("  dump (d) <filename>: Read file <filename> and write it to stdout\n")
-	fmt.Printf("  extract (x) <filename>: Copy file <filename> to the current directory\n")
-	fmt.Printf("  extractall (xa): Copy all files to the current directory\n")
+	case "tar":
+		i++
+		fs := newFlagSet("tar")
+		text := fs.Bool("text", false, "convert Oberon text to UTF-8")
+		if err := parseFlags(fs, args[i:]); err != nil {
+			return nil, err
+		}
+		if fs.NArg() > 0 {
+			return nil, errors.New("unexpected args")
+		}
+		command := func() error {
+			return writeTar(floppy, os.Stdout, *text)
+		}
+		return command, nil
+	case "zip":
+		i++
+		fs := newFlagSet("zip")
+		text := fs.Bool("text", false, "convert Oberon text to UTF-8")
+		if err := parseFlags(fs, args[i:]); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return nil, errors.New("filename missing")
+		}
+		if fs.NArg() > 1 {
+			return nil, errors.New("unexpected args")
+		}
+		zipFile := fs.Arg(0)
+		command := func() error {
+			return writeZip(floppy, zipFile, *text)
+		}
+		return command, nil
+	case "diff":
+		i++
+		fs := newFlagSet("diff")
+		noContent := fs.Bool("no-content", false, "don't compare the contents of the files")
+		if err := parseFlags(fs, args[i:]); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return nil, errors.New("image file missing")
+		}
+		if fs.NArg() > 1 {
+			return nil, errors.New("unexpected args")
+		}
+		otherFile := fs.Arg(0)
+		command := func() error {
+			other, err := setup.open(open, otherFile)
+			if err != nil {
+				return fmt.Errorf("%s: %w", otherFile, err)
+			}
+			defer other.Close()
+			return diff(floppy, other, !*noContent)
+		}
+		return command, nil
+	case "shell":
+		i++
+		if imageFile == "-" {
+			return nil, errors.New("the shell reads commands from stdin, the image must be read from a file")
+		}
+		if i < len(args) {
+			return nil, errors.New("unexpected args")
+		}
+		command := func() error {
+			return shell(floppy, imageFile, open, setup)
+		}
+		return command, nil
+	case "info":
+		i++
+		if i < len(args) {
+			return nil, errors.New("unexpected args")
+		}
+		command := func() error {
+			return printInfo(floppy)
+		}
+		return command, nil
+	case "add":
+		i++
+		if imageFile == "-" {
+			return nil, errReadOnlyStdin
+		}
+		if i >= len(args) {
+			return nil, errors.New("filename missing")
+		}
+		localFile := args[i]
+		name := filepath.Base(localFile)
+		i++
+		if i < len(args) {
+			name = args[i]
+			i++
+		}
+		if i < len(args) {
+			return nil, errors.New("unexpected args")
+		}
+		command := func() error {
+			data, err := os.ReadFile(localFile)
+			if err != nil {
+				return err
+			}
+			fi, err := os.Stat(localFile)
+			if err != nil {
+				return err
+			}
+			if err := floppy.AddFile(name, data, fi.ModTime()); err != nil {
+				return err
+			}
+			return floppy.Save(imageFile)
+		}
+		return command, nil
+	case "rename":
+		i++
+		if imageFile == "-" {
+			return nil, errReadOnlyStdin
+		}
+		if i+1 >= len(args) {
+			return nil, errors.New("filename missing")
+		}
+		oldName, newName := args[i], args[i+1]
+		i += 2
+		if i < len(args) {
+			return nil, errors.New("unexpected args")
+		}
+		command := func() error {
+			if err := floppy.RenameFile(oldName, newName); err != nil {
+				return err
+			}
+			return floppy.Save(imageFile)
+		}
+		return command, nil
+	case "touch":
+		i++
+		if imageFile == "-" {
+			return nil, errReadOnlyStdin
+		}
+		fs := newFlagSet("touch")
+		clearTime := fs.Bool("clear", false, "clear the timestamp")
+		if err := parseFlags(fs, args[i:]); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return nil, errors.New("filename missing")
+		}
+		if fs.NArg() > 2 || (*clearTime && fs.NArg() > 1) {
+			return nil, errors.New("unexpected args")
+		}
+		name := fs.Arg(0)
+		t := time.Now()
+		if *clearTime {
+			t = time.Time{}
+		} else if fs.NArg() == 2 {
+			var err error
+			t, err = time.Parse(time.RFC3339, fs.Arg(1))
+			if err != nil {
+				return nil, fmt.Errorf("invalid time %q, use RFC 3339 like 2006-01-02T15:04:05Z", fs.Arg(1))
+			}
+		}
+		command := func() error {
+			if err := floppy.SetFileTimestamp(name, t); err != nil {
+				return err
+			}
+			return floppy.Save(imageFile)
+		}
+		return command, nil
+	case "rm":
+		i++
+		if imageFile == "-" {
+			return nil, errReadOnlyStdin
+		}
+		if i >= len(args) {
+			return nil, errors.New("filename missing")
+		}
+		name := args[i]
+		i++
+		if i < len(args) {
+			return nil, errors.New("unexpected args")
+		}
+		command := func() error {
+			if err := floppy.RemoveFile(name); err != nil {
+				return err
+			}
+			return floppy.Save(imageFile)
+		}
+		return command, nil
+	case "sha256":
+		i++
+		fs := newFlagSet("sha256")
+		all := fs.Bool("all", false, "print the hashes of all files")
+		if err := parseFlags(fs, args[i:]); err != nil {
+			return nil, err
+		}
+		if !*all && fs.NArg() == 0 {
+			return nil, errors.New("filename missing")
+		}
+		if (*all && fs.NArg() > 0) || fs.NArg() > 1 {
+			return nil, errors.New("unexpected args")
+		}
+		name := fs.Arg(0)
+		command := func() error {
+			fds, err := floppy.ListFiles()
+			if err != nil {
+				return err
+			}
+			found := false
+			for _, fd := range fds {
+				if !*all && fd.Name() != name {
+					continue
+				}
+				data, err := floppy.ReadFile(fd)
+				if err != nil {
+					return err
+				}
+				fmt.Printf("%x  %s\n", sha256.Sum256(data), fd.Name())
+				found = true
+			}
+			if !*all && !found {
+				return fmt.Errorf("%w: %q", oberon.ErrFileNotFound, name)
+			}
+			return nil
+		}
+		return command, nil
+	case "chain":
+		i++
+		if i >= len(args) {
+			return nil, errors.New("filename missing")
+		}
+		name := args[i]
+		i++
+		if i < len(args) {
+			return nil, errors.New("unexpected args")
+		}
+		command := func() error {
+			fds, err := floppy.ListFiles()
+			if err != nil {
+				return err
+			}
+			for _, fd := range fds {
+				if fd.Name() == name {
+					return printChain(floppy, fd)
+				}
+			}
+			return fmt.Errorf("%w: %q", oberon.ErrFileNotFound, name)
+		}
+		return command, nil
+	case "count":
+		i++
+		fs := newFlagSet("count")
+		deleted := fs.Bool("deleted", false, "count the deleted files instead")
+		if err := parseFlags(fs, args[i:]); err != nil {
+			return nil, err
+		}
+		if fs.NArg() > 0 {
+			return nil, errors.New("unexpected args")
+		}
+		command := func() error {
+			list := floppy.ListFiles
+			if *deleted {
+				list = floppy.ListDeletedFiles
+			}
+			fds, err := list()
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%d\n", len(fds))
+			return nil
+		}
+		return command, nil
+	case "fingerprint":
+		i++
+		if i < len(args) {
+			return nil, errors.New("unexpected args")
+		}
+		command := func() error {
+			return printFingerprint(floppy, imageFile)
+		}
+		return command, nil
+	case "entry":
+		i++
+		if i >= len(args) {
+			return nil, errors.New("filename missing")
+		}
+		name := args[i]
+		i++
+		if i < len(args) {
+			return nil, errors.New("unexpected args")
+		}
+		command := func() error {
+			fds, err := floppy.ListFiles()
+			if err != nil {
+				return err
+			}
+			for _, fd := range fds {
+				if fd.Name() == name {
+					printEntry(fd)
+					return nil
+				}
+			}
+			return fmt.Errorf("%w: %q", oberon.ErrFileNotFound, name)
+		}
+		return command, nil
+	case "slack":
+		i++
+		if i < len(args) {
+			return nil, errors.New("unexpected args")
+		}
+		command := func() error {
+			fds, err := floppy.ListFiles()
+			if err != nil {
+				return err
+			}
+			clusterSize := int32(floppy.FATBlockSize())
+			total := int32(0)
+			for _, fd := range fds {
+				slack := int32(0)
+				if fd.Size()%clusterSize != 0 {
+					slack = clusterSize - fd.Size()%clusterSize
+				}
+				total += slack
+				fmt.Printf("%5d  %s\n", slack, fd.DisplayName())
+			}
+			fmt.Printf("%d bytes of slack in %d files\n", total, len(fds))
+			return nil
+		}
+		return command, nil
+	case "fat":
+		i++
+		if i < len(args) {
+			return nil, errors.New("unexpected args")
+		}
+		command := func() error {
+			printFAT(floppy.FAT())
+			return nil
+		}
+		return command, nil
+	case "undelete":
+		i++
+		if i >= len(args) {
+			return nil, errors.New("filename missing")
+		}
+		name := args[i]
+		i++
+		if i < len(args) {
+			return nil, errors.New("unexpected args")
+		}
+		command := func() error {
+			return undelete(floppy, name)
+		}
+		return command, nil
+	case "check":
+		i++
+		fs := newFlagSet("check")
+		quiet := fs.Bool("q", false, "only print problems")
+		if err := parseFlags(fs, args[i:]); err != nil {
+			return nil, err
+		}
+		if fs.NArg() > 0 {
+			return nil, errors.New("unexpected args")
+		}
+		command := func() error {
+			return check(floppy, *quiet)
+		}
+		return command, nil
+	case "fsck":
+		i++
+		fs := newFlagSet("fsck")
+		quiet := fs.Bool("q", false, "only print problems")
+		if err := parseFlags(fs, args[i:]); err != nil {
+			return nil, err
+		}
+		if fs.NArg() > 0 {
+			return nil, errors.New("unexpected args")
+		}
+		command := func() error {
+			return fsck(floppy, *quiet)
+		}
+		return command, nil
+	default:
+		return nil, fmt.Errorf("%w: %q", errUnknownCommand, args[i])
+	}
+}
+
+func listDeletedFiles(fl *oberon.Floppy) error {
+	fds, err := fl.ListDeletedFiles()
+	if err != nil {
+		return err
+	}
+	for _, fd := range fds {
+		state := "blocks reused"
+		if fl.Recoverable(fd) {
+			state = "recoverable"
+		}
+		fmt.Printf("%5d  %s  %-23s  %s\n", fd.Size(), fd.Timestamp().Format(time.DateTime), fd.DisplayName(), state)
+	}
+	return nil
+}
+
+// printFingerprint prints the SHA-256 hash of the complete image, in the
+// same format as sha256sum, followed by its size and number of files.
+func printFingerprint(fl *oberon.Floppy, imageFile string) error {
+	h := sha256.New()
+	size, err := fl.WriteTo(h)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%x  %s\n", h.Sum(nil), imageFile)
+	fds, err := fl.ListFiles()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d bytes, %d files\n", size, len(fds))
+	return nil
+}
+
+// printEntry prints the raw bytes of the directory entry of fd, followed
+// by its fields, each with its offset, its decoded value and its bytes.
+func printEntry(fd oberon.FileDesc) {
+	raw := fd.Raw()
+	fmt.Print(hex.Dump(raw))
+	date, tod := "invalid", "invalid"
+	if fd.ValidTimestamp() {
+		ts := fd.Timestamp()
+		date, tod = ts.Format(time.DateOnly), ts.Format(time.TimeOnly)
+	}
+	fields := []struct {
+		name       string
+		start, end int
+		value      string
+	}{
+		{"name", 0, 22, fd.DisplayName()},
+		{"time", 22, 24, tod},
+		{"date", 24, 26, date},
+		{"head", 26, 28, strconv.Itoa(int(fd.Head()))},
+		{"size", 28, 32, strconv.Itoa(int(fd.Size()))},
+	}
+	for _, f := range fields {
+		fmt.Printf("%2d-%2d  %s  %-23s  % x\n", f.start, f.end-1, f.name, f.value, raw[f.start:f.end])
+	}
+}
+
+// printChain prints the FAT blocks occupied by fd, e.g.
+// "head=12 -> 13 -> 40 -> EOF". If the chain is broken, the blocks up to
+// the break are printed, followed by "?".
+func printChain(fl *oberon.Floppy, fd oberon.FileDesc) error {
+	chain, err := fl.Chain(fd)
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "head=%d", fd.Head())
+	for _, b := range chain[min(1, len(chain)):] {
+		fmt.Fprintf(&sb, " -> %d", b)
+	}
+	if err != nil {
+		fmt.Printf("%s -> ?\n", sb.String())
+		return err
+	}
+	fmt.Printf("%s -> EOF\n", sb.String())
+	return nil
+}
+
+// printFAT prints the FAT entries, 16 per line. Free entries are printed
+// as ".", the end of a chain as "EOF", bad blocks as "BAD" and reserved
+// entries as "RES". Other entries are the next block of the chain.
+func printFAT(fat []int32) {
+	for i, n := range fat {
+		if i%16 == 0 {
+			fmt.Printf("%4d:", i)
+		}
+		switch {
+		case i < 2:
+			fmt.Printf(" %4s", "RES")
+		case n == 0:
+			fmt.Printf(" %4s", ".")
+		case n >= -8 && n < 0:
+			fmt.Printf(" %4s", "EOF")
+		case n == -9:
+			fmt.Printf(" %4s", "BAD")
+		case n < 0:
+			fmt.Printf(" %4s", "RES")
+		default:
+			fmt.Printf(" %4d", n)
+		}
+		if i%16 == 15 || i == len(fat)-1 {
+			fmt.Println()
+		}
+	}
+}
+
+// undelete recovers the deleted file called name and writes it to the
+// current directory. As the first character of a deleted file's name is
+// lost, it is ignored when looking for the file.
+func undelete(fl *oberon.Floppy, name string) error {
+	fds, err := fl.ListDeletedFiles()
+	if err != nil {
+		return err
+	}
+	for _, fd := range fds {
+		if len(name) == 0 || fd.Name()[1:] != name[1:] {
+			continue
+		}
+		if _, err := os.Stat(name); err == nil {
+			return fmt.Errorf("%s exists already", name)
+		}
+		fmt.Fprintf(os.Stderr, "WARNING: Recovering deleted files is best effort only. The blocks of\n")
+		fmt.Fprintf(os.Stderr, "WARNING: %s might have been reused, check the recovered data carefully!\n", fd.Name())
+		if !fl.Recoverable(fd) {
+			fmt.Fprintf(os.Stderr, "WARNING: Some blocks of %s are in use by other files.\n", fd.Name())
+		}
+		data, err := fl.RecoverFile(fd)
+		if err != nil {
+			return err
+		}
+		return writeFile(name, data, fd)
+	}
+	return fmt.Errorf("No deleted file matches %q", name)
+}
+
+func displayLabel(label string) string {
+	if strings.TrimSpace(label) == "" {
+		return "(no label)"
+	}
+	return label
+}
+
+// shell reads commands from stdin and runs them on floppy, until "quit"
+// or the end of the input.
+func shell(floppy *oberon.Floppy, imageFile string, open func(string) (*oberon.Floppy, error), setup floppySetup) error {
+	scanner := bufio.NewScanner(os.Stdin)
+	for {
+		fmt.Printf("cft> ")
+		if !scanner.Scan() {
+			fmt.Println()
+			return scanner.Err()
+		}
+		fields := strings.Fields(scanner.Text())
+		switch {
+		case len(fields) == 0:
+			continue
+		case fields[0] == "quit" || fields[0] == "exit":
+			return nil
+		case fields[0] == "shell":
+			fmt.Printf("Already in the shell\n")
+			continue
+		case fields[0] == "help":
+			printUsage()
+			continue
+		}
+		cmd, err := parseCommand(floppy, imageFile, open, setup, append([]string{imageFile}, fields...))
+		if err == nil {
+			err = cmd()
+		}
+		if err != nil {
+			fmt.Printf("Error: %s\n", err)
+		}
+	}
+}
+
+func printInfo(fl *oberon.Floppy) error {
+	if err := fl.CheckLayout(); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %s\n", err)
+	}
+	fmt.Printf("Media descriptor: 0x%02x\n", fl.MediaDescriptor())
+	fmt.Printf("Total blocks:     %d\n", fl.BlockCount())
+	fmt.Printf("OEM name:         %s\n", fl.OEMName())
+	if serial, ok := fl.SerialNumber(); ok {
+		fmt.Printf("Serial number:    %04X-%04X\n", serial>>16, serial&0xffff)
+	} else {
+		fmt.Printf("Serial number:\n")
+	}
+	label, err := fl.VolumeLabel()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Volume label:     %s\n", displayLabel(label))
+	fds, err := fl.ListFiles()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Files:            %d\n", len(fds))
+	free := fl.FreeBlocks()
+	fmt.Printf("Free space:       %d bytes (%d blocks of %d bytes)\n", free*fl.FATBlockSize(), free, fl.FATBlockSize())
+	return nil
+}
+
+// check reads the directory and all files, and prints a one-line summary
+// if the image is fine. It stops at the first problem.
+func check(fl *oberon.Floppy, quiet bool) error {
+	files := 0
+	err := fl.ForEachFile(func(fd oberon.FileDesc) error {
+		if _, err := fl.ReadFile(fd); err != nil {
+			return fmt.Errorf("%s: %w", fd.Name(), err)
+		}
+		files++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if !quiet {
+		fmt.Printf("OK: %d files\n", files)
+	}
+	return nil
+}
+
+// diff prints a line for every file that was added, removed or changed
+// in b compared to a. Files are matched by name. If content is set, the
+// contents of files with the same size and timestamp are compared, too.
+func diff(a, b *oberon.Floppy, content bool) error {
+	afds, err := a.ListFiles()
+	if err != nil {
+		return err
+	}
+	bfds, err := b.ListFiles()
+	if err != nil {
+		return err
+	}
+	byName := make(map[string]oberon.FileDesc)
+	for _, fd := range bfds {
+		byName[fd.Name()] = fd
+	}
+	for _, afd := range afds {
+		bfd, found := byName[afd.Name()]
+		if !found {
+			fmt.Printf("- %s\n", afd.Name())
+			continue
+		}
+		var changes []string
+		if afd.Size() != bfd.Size() {
+			changes = append(changes, fmt.Sprintf("size %d -> %d", afd.Size(), bfd.Size()))
+		}
+		if !afd.Timestamp().Equal(bfd.Timestamp()) {
+			changes = append(changes, fmt.Sprintf("timestamp %s -> %s", afd.Timestamp().Format(time.DateTime), bfd.Timestamp().Format(time.DateTime)))
+		}
+		if content && len(changes) == 0 {
+			adata, err := a.ReadFile(afd)
+			if err != nil {
+				return fmt.Errorf("%s: %w", afd.Name(), err)
+			}
+			bdata, err := b.ReadFile(bfd)
+			if err != nil {
+				return fmt.Errorf("%s: %w", bfd.Name(), err)
+			}
+			if !bytes.Equal(adata, bdata) {
+				changes = append(changes, "content")
+			}
+		}
+		if len(changes) > 0 {
+			fmt.Printf("M %s (%s)\n", afd.Name(), strings.Join(changes, ", "))
+		}
+	}
+	inA := make(map[string]bool)
+	for _, fd := range afds {
+		inA[fd.Name()] = true
+	}
+	for _, fd := range bfds {
+		if !inA[fd.Name()] {
+			fmt.Printf("+ %s\n", fd.Name())
+		}
+	}
+	return nil
+}
+
+// fsck cross-checks the directory entries against the FAT and prints a
+// line for every problem found.
+func fsck(fl *oberon.Floppy, quiet bool) error {
+	fds, err := fl.ListFiles()
+	if err != nil {
+		return err
+	}
+	problems := 0
+	report := func(fd oberon.FileDesc, format string, args ...any) {
+		fmt.Printf("%s: %s\n", fd.DisplayName(), fmt.Sprintf(format, args...))
+		problems++
+	}
+	if err := fl.CheckLayout(); err != nil {
+		fmt.Printf("layout: %s\n", err)
+		problems++
+	}
+	owner := make(map[int32]string)
+	for _, fd := range fds {
+		if fd.Size() < 0 {
+			report(fd, "invalid size %d", fd.Size())
+		}
+		chain, err := fl.Chain(fd)
+		if err != nil {
+			report(fd, "%s", err)
+		}
+		for _, b := range chain {
+			if other, found := owner[b]; found {
+				report(fd, "block %d is also used by %s", b, other)
+				continue
+			}
+			owner[b] = fd.Name()
+		}
+		// Empty files may or may not occupy a block
+		want := (int(fd.Size()) + fl.FATBlockSize() - 1) / fl.FATBlockSize()
+		if err == nil && fd.Size() > 0 && len(chain) != want {
+			report(fd, "chain has %d blocks, but size %d needs %d", len(chain), fd.Size(), want)
+		}
+	}
+	if problems > 0 {
+		return fmt.Errorf("%d problems found", problems)
+	}
+	if !quiet {
+		fmt.Printf("No problems found\n")
+	}
+	return nil
+}
+
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	// Errors are reported by main, together with the usage
+	fs.SetOutput(io.Discard)
+	return fs
+}
+
+type jsonFileDesc struct {
+	Name      string `json:"name"`
+	Size      int32  `json:"size"`
+	Timestamp string `json:"timestamp"`
+	Head      int16  `json:"head"`
+}
+
+func printJSONListing(fds []oberon.FileDesc) error {
+	res := make([]jsonFileDesc, 0, len(fds))
+	for _, fd := range fds {
+		res = append(res, jsonFileDesc{
+			Name:      fd.Name(),
+			Size:      fd.Size(),
+			Timestamp: fd.Timestamp().Format(time.RFC3339),
+			Head:      fd.Head(),
+		})
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(res)
+}
+
+// humanSize formats size like ls -h does, e.g. "340B" or "1.2K".
+func humanSize(size int32) string {
+	switch {
+	case size < 1024:
+		return fmt.Sprintf("%dB", size)
+	case size < 1024*1024:
+		return fmt.Sprintf("%.1fK", float64(size)/1024)
+	default:
+		return fmt.Sprintf("%.1fM", float64(size)/(1024*1024))
+	}
+}
+
+// parseDate parses s, which is either a date (YYYY-MM-DD), meaning
+// midnight in the time zone of the floppy's timestamps, or a time in
+// RFC 3339 format.
+func parseDate(s string) (time.Time, error) {
+	if t, err := time.ParseInLocation(time.DateOnly, s, oberon.Location()); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date %q, use YYYY-MM-DD or RFC 3339", s)
+	}
+	return t, nil
+}
+
+// sortOrder returns the indices of fds in the order given by key, which is
+// "name", "size", "date", or "" for the directory order. Files with the
+// same key stay in directory order.
+func sortOrder(fds []oberon.FileDesc, key string, reverse bool) []int {
+	order := make([]int, len(fds))
+	for k := range order {
+		order[k] = k
+	}
+	var compare func(a, b oberon.FileDesc) int
+	switch key {
+	case "name":
+		compare = func(a, b oberon.FileDesc) int { return strings.Compare(a.Name(), b.Name()) }
+	case "size":
+		compare = func(a, b oberon.FileDesc) int { return cmp.Compare(a.Size(), b.Size()) }
+	case "date":
+		compare = func(a, b oberon.FileDesc) int { return a.Timestamp().Compare(b.Timestamp()) }
+	default:
+		if reverse {
+			slices.Reverse(order)
+		}
+		return order
+	}
+	slices.SortStableFunc(order, func(a, b int) int {
+		c := compare(fds[a], fds[b])
+		if reverse {
+			c = -c
+		}
+		return c
+	})
+	return order
+}
+
+// printCSVListing prints the files as CSV, with a header line.
+func printCSVListing(fds []oberon.FileDesc) error {
+	w := csv.NewWriter(os.Stdout)
+	w.Write([]string{"name", "size", "timestamp", "head"})
+	for _, fd := range fds {
+		w.Write([]string{
+			fd.Name(),
+			strconv.Itoa(int(fd.Size())),
+			fd.Timestamp().Format(time.RFC3339),
+			strconv.Itoa(int(fd.Head())),
+		})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// formatFileDesc is what the templates given with list -format see.
+type formatFileDesc struct {
+	Name string
+	Size int32
+	Time time.Time
+	Head int16
+}
+
+func printFormattedListing(fds []oberon.FileDesc, tmpl *template.Template) error {
+	for _, fd := range fds {
+		err := tmpl.Execute(os.Stdout, formatFileDesc{
+			Name: fd.Name(),
+			Size: fd.Size(),
+			Time: fd.Timestamp(),
+			Head: fd.Head(),
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Println()
+	}
+	return nil
+}
+
+// dumpFile writes the contents of fd to stdout. With raw, the slack of
+// the last block is written, too. With text, the contents are converted
+// to UTF-8.
+func dumpFile(fl *oberon.Floppy, fd oberon.FileDesc, raw, text, report bool) error {
+	if !raw && !text {
+		r, err := fl.Open(fd)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		_, err = io.Copy(os.Stdout, r)
+		return err
+	}
+	read := fl.ReadFile
+	if raw {
+		read = fl.ReadFileRaw
+	}
+	data, err := read(fd)
+	if err != nil {
+		return err
+	}
+	if text {
+		data = convertText(fd, data, report)
+	}
+	_, err = os.Stdout.Write(data)
+	return err
+}
+
+// matchFiles returns the files whose names match the shell pattern. The
+// pattern must already have been checked with path.Match.
+func matchFiles(fds []oberon.FileDesc, pattern string, ignoreCase bool) []oberon.FileDesc {
+	if ignoreCase {
+		pattern = strings.ToLower(pattern)
+	}
+	var res []oberon.FileDesc
+	for _, fd := range fds {
+		name := fd.Name()
+		if ignoreCase {
+			name = strings.ToLower(name)
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			res = append(res, fd)
+		}
+	}
+	return res
+}
+
+type extractOptions struct {
+	outDir    string
+	text      bool
+	report    bool
+	dryRun    bool
+	force     bool
+	splitDots bool
+}
+
+func (o *extractOptions) addFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.outDir, "o", "", "write files to `dir` instead of the current directory")
+	fs.BoolVar(&o.text, "text", false, "convert Oberon text to UTF-8")
+	fs.BoolVar(&o.report, "report", false, "report the changes made by -text to stderr")
+	fs.BoolVar(&o.dryRun, "n", false, "only print what would be written")
+	fs.BoolVar(&o.dryRun, "dry-run", false, "only print what would be written")
+	fs.BoolVar(&o.force, "force", false, "overwrite existing files")
+}
+
+// fileName returns the path, relative to the output directory, the file
+// called name is written to. With splitDots, the part of the name before
+// the first dot becomes a directory, e.g. "Kernel.Mod" is written to
+// "Kernel/Mod". Both parts are made safe with safeName; names whose parts
+// can't be made safe, e.g. "Kernel..", are not split.
+func (o *extractOptions) fileName(name string) (string, error) {
+	if dir, rest, found := strings.Cut(name, "."); o.splitDots && found {
+		safeDir, dirErr := safeName(dir)
+		safeRest, restErr := safeName(rest)
+		if dirErr == nil && restErr == nil {
+			return filepath.Join(safeDir, safeRest), nil
+		}
+	}
+	return safeName(name)
+}
+
+// prepare creates the output directory, if necessary.
+func (o *extractOptions) prepare() error {
+	if o.outDir == "" || o.dryRun {
+		return nil
+	}
+	return os.MkdirAll(o.outDir, 0777)
+}
+
+// extractFile writes fd to the output directory, and returns the name of
+// the file written, relative to the output directory. The name is "" if
+// nothing was written. If only a part of the file can be read, the part is
+// written to a file with the suffix ".partial", and the error is returned
+// anyway.
+func extractFile(fl *oberon.Floppy, fd oberon.FileDesc, opts extractOptions) (string, error) {
+	data, readErr := fl.ReadFile(fd)
+	partial := errors.Is(readErr, oberon.ErrTruncated) && len(data) > 0
+	if readErr != nil && !partial {
+		return "", readErr
+	}
+	if opts.text {
+		data = convertText(fd, data, opts.report)
+	}
+	name, err := opts.fileName(fd.Name())
+	if err != nil {
+		return "", err
+	}
+	if opts.splitDots {
+		// A file like "Kernel" might have been extracted before "Kernel.Mod"
+		dir := filepath.Join(opts.outDir, filepath.Dir(name))
+		if isRegularFile(dir) {
+			fmt.Fprintf(os.Stderr, "Warning: %s is a file, not a directory, writing %q unsplit\n", dir, fd.Name())
+			if name, err = safeName(fd.Name()); err != nil {
+				return "", err
+			}
+		}
+	}
+	if isDirectory(filepath.Join(opts.outDir, name)) {
+		// E.g. "Kernel" after "Kernel.Mod" was written to Kernel/Mod
+		name += "_"
+	}
+	// With -split-dots, the first path separator stands for the first dot
+	if strings.Replace(filepath.ToSlash(name), "/", ".", 1) != fd.Name() {
+		fmt.Fprintf(os.Stderr, "Warning: writing %q as %s\n", fd.Name(), name)
+	}
+	if partial {
+		name += ".partial"
+	}
+	destName := filepath.Join(opts.outDir, name)
+	_, err = os.Stat(destName)
+	exists := err == nil
+	if opts.dryRun {
+		switch {
+		case exists && opts.force:
+			fmt.Printf("%s (exists already, will be overwritten)\n", destName)
+		case exists:
+			fmt.Printf("%s (exists already, will be skipped)\n", destName)
+		default:
+			fmt.Printf("%s\n", destName)
+		}
+		return "", readErr
+	}
+	if exists && !opts.force {
+		fmt.Fprintf(os.Stderr, "Warning: %s exists already, skipping it\n", destName)
+		return "", readErr
+	}
+	if opts.splitDots {
+		if err := os.MkdirAll(filepath.Dir(destName), 0777); err != nil {
+			return "", err
+		}
+	}
+	if err := writeFile(destName, data, fd); err != nil {
+		return "", err
+	}
+	return name, readErr
+}
+
+// extractFailures returns the error for the files that could not be
+// extracted. A single error is returned as is, several are printed and
+// summarized.
+func extractFailures(failures []error) error {
+	if len(failures) == 1 {
+		return failures[0]
+	}
+	for _, err := range failures {
+		fmt.Printf("%s\n", err)
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("%d files could not be extracted", len(failures))
+	}
+	return nil
+}
+
+// isRegularFile reports whether name exists and is not a directory.
+func isRegularFile(name string) bool {
+	fi, err := os.Stat(name)
+	return err == nil && !fi.IsDir()
+}
+
+// isDirectory reports whether name exists and is a directory.
+func isDirectory(name string) bool {
+	fi, err := os.Stat(name)
+	return err == nil && fi.IsDir()
+}
+
+// convertText converts data, the contents of fd, from Oberon text to UTF-8.
+// With report, the number of changes is printed to stderr.
+func convertText(fd oberon.FileDesc, data []byte, report bool) []byte {
+	res, stats := oberon.ConvertText(data)
+	if report {
+		fmt.Fprintf(os.Stderr, "%s: %d line ends converted, %d characters translated, %d replaced\n",
+			fd.DisplayName(), stats.LineEnds, stats.Translated, stats.Replaced)
+	}
+	return res
+}
+
+// manifestEntry describes an extracted file in manifest.json.
+type manifestEntry struct {
+	Name      string `json:"name"`
+	File      string `json:"file"`
+	Size      int32  `json:"size"`
+	Timestamp string `json:"timestamp"`
+	Head      int16  `json:"head"`
+	SHA256    string `json:"sha256"`
+}
+
+// extractedFile is a file written by extractFile, with the name it was
+// written to.
+type extractedFile struct {
+	fd   oberon.FileDesc
+	file string
+}
+
+// writeManifest writes a JSON description of the extracted files to
+// filename, sorted by name. The hashes are computed from the contents on
+// the floppy, before any conversion; for partially extracted files, from
+// the part that could be read.
+func writeManifest(fl *oberon.Floppy, files []extractedFile, filename string) error {
+	var entries []manifestEntry
+	for _, f := range files {
+		fd := f.fd
+		data, err := fl.ReadFile(fd)
+		if err != nil && !errors.Is(err, oberon.ErrTruncated) {
+			return fmt.Errorf("%s: %w", fd.Name(), err)
+		}
+		entries = append(entries, manifestEntry{
+			Name:      fd.Name(),
+			File:      f.file,
+			Size:      fd.Size(),
+			Timestamp: fd.Timestamp().Format(time.RFC3339),
+			Head:      fd.Head(),
+			SHA256:    fmt.Sprintf("%x", sha256.Sum256(data)),
+		})
+	}
+	slices.SortStableFunc(entries, func(a, b manifestEntry) int { return strings.Compare(a.Name, b.Name) })
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, append(data, '\n'), 0666)
+}
+
+// safeName turns a file name read from a floppy into one that can be
+// written to safely: Path separators and control characters are replaced
+// by '_'. Names that refer to directories are rejected. Corrupt or crafted
+// images could otherwise make us write outside of the destination
+// directory. On Windows, the characters and names Windows reserves are
+// replaced, too.
+func safeName(name string) (string, error) {
+	windows := runtime.GOOS == "windows"
+	res := strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r < 0x20 || r == 0x7f {
+			return '_'
+		}
+		if windows && strings.ContainsRune(`<>:"|?*`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	if res == "" || res == "." || res == ".." {
+		return "", fmt.Errorf("unsafe file name %q", name)
+	}
+	if windows {
+		// Windows drops trailing dots and spaces, and treats device names
+		// as devices even if they have an extension.
+		if strings.HasSuffix(res, ".") || strings.HasSuffix(res, " ") {
+			res += "_"
+		}
+		base, _, _ := strings.Cut(res, ".")
+		if windowsDeviceNames[strings.ToUpper(base)] {
+			res = "_" + res
+		}
+	}
+	return res, nil
+}
+
+var windowsDeviceNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// writeFile writes data to destName, and sets its modification time to
+// the one of fd.
+func writeFile(destName string, data []byte, fd oberon.FileDesc) error {
+	err := os.WriteFile(destName, data, 0666)
+	if err != nil {
+		return err
+	}
+
+	if !fd.ValidTimestamp() {
+		// Garbage in the date fields, e.g. for empty files
+		return nil
+	}
+	// Only the modification time comes from the floppy, the file was just
+	// accessed.
+	err = os.Chtimes(destName, time.Now(), fd.Timestamp())
+	return err
+}
+
+// parseMultiImageCommandLine parses the command line following -images.
+// The first arg is a comma-separated list of image files, the second one
+// the command. Only list is supported.
+func parseMultiImageCommandLine(args []string, open func(string) (*oberon.Floppy, error), setup floppySetup) (cmd command, err error) {
+	if len(args) == 0 {
+		return nil, errors.New("image files missing")
+	}
+	images := strings.Split(args[0], ",")
+	if len(args) < 2 {
+		return nil, errors.New("command missing")
+	}
+	switch args[1] {
+	case "l", "list":
+		if len(args) > 2 {
+			return nil, errors.New("unexpected args")
+		}
+		command := func() error {
+			return listImages(images, open, setup)
+		}
+		return command, nil
+	}
+	return nil, fmt.Errorf("%w for multiple images: %q", errUnknownCommand, args[1])
+}
+
+// listImages prints a combined listing of the files in all images, with
+// the image every file is stored on.
+func listImages(images []string, open func(string) (*oberon.Floppy, error), setup floppySetup) error {
+	for _, image := range images {
+		fl, err := setup.open(open, image)
+		if err != nil {
+			return fmt.Errorf("%s: %w", image, err)
+		}
+		fds, err := fl.ListFiles()
+		fl.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", image, err)
+		}
+		for _, fd := range fds {
+			fmt.Printf("%5d  %s  %-23s  %s\n", fd.Size(), fd.Timestamp().Format(time.DateTime), fd.DisplayName(), image)
+		}
+	}
+	return nil
+}
+
+// parseBatchCommandLine parses the command line of the batch command: a
+// directory and the command to run for every image in it.
+func parseBatchCommandLine(args []string, open func(string) (*oberon.Floppy, error), setup floppySetup) (cmd command, err error) {
+	if len(args) == 0 {
+		return nil, errors.New("directory missing")
+	}
+	dir := args[0]
+	if len(args) < 2 {
+		return nil, errors.New("command missing")
+	}
+	switch args[1] {
+	case "batch", "shell":
+		return nil, fmt.Errorf("%q can't be run in a batch", args[1])
+	}
+	command := func() error {
+		return runBatch(dir, args[1:], open, setup)
+	}
+	return command, nil
+}
+
+// parseDiffCommandLine parses the command line of the top-level form of
+// diff, which takes both images as parameters.
+func parseDiffCommandLine(args []string, open func(string) (*oberon.Floppy, error), setup floppySetup) (cmd command, err error) {
+	fs := newFlagSet("diff")
+	noContent := fs.Bool("no-content", false, "don't compare the contents of the files")
+	if err := parseFlags(fs, args); err != nil {
+		var he helpError
+		if errors.As(err, &he) {
+			command := func() error {
+				return printCommandHelp("diff", fs)
+			}
+			return command, nil
+		}
+		return nil, err
+	}
+	if fs.NArg() < 2 {
+		return nil, errors.New("image files missing")
+	}
+	if fs.NArg() > 2 {
+		return nil, errors.New("unexpected args")
+	}
+	fileA, fileB := fs.Arg(0), fs.Arg(1)
+	command := func() error {
+		a, err := setup.open(open, fileA)
+		if err != nil {
+			return fmt.Errorf("%s: %w", fileA, err)
+		}
+		defer a.Close()
+		b, err := setup.open(open, fileB)
+		if err != nil {
+			return fmt.Errorf("%s: %w", fileB, err)
+		}
+		defer b.Close()
+		return diff(a, b, !*noContent)
+	}
+	return command, nil
+}
+
+// runBatch runs the command given by args for every *.img file in dir.
+// Every line the command prints is prefixed with the image's name. Images
+// for which the command fails are reported, and the remaining ones are
+// processed anyway.
+func runBatch(dir string, args []string, open func(string) (*oberon.Floppy, error), setup floppySetup) error {
+	images, err := filepath.Glob(filepath.Join(dir, "*.img"))
+	if err != nil {
+		return err
+	}
+	if len(images) == 0 {
+		return fmt.Errorf("no images in %s", dir)
+	}
+	failed := 0
+	for _, image := range images {
+		name := filepath.Base(image)
+		err := withPrefixedStdout(name+": ", func() error {
+			fl, err := setup.open(open, image)
+			if err != nil {
+				return err
+			}
+			defer fl.Close()
+			cmd, err := parseCommand(fl, image, open, setup, append([]string{image}, args...))
+			if err != nil {
+				return err
+			}
+			return cmd()
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", name, err)
+			failed++
+		}
+	}
+	fmt.Printf("%d of %d images succeeded\n", len(images)-failed, len(images))
+	if failed > 0 {
+		return fmt.Errorf("%d of %d images failed", failed, len(images))
+	}
+	return nil
+}
+
+// withPrefixedStdout calls fn and prefixes every line it writes to stdout
+// with prefix.
+func withPrefixedStdout(prefix string, fn func() error) error {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	stdout := os.Stdout
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		br := bufio.NewReader(r)
+		for {
+			line, err := br.ReadString('\n')
+			if line != "" {
+				if !strings.HasSuffix(line, "\n") {
+					line += "\n"
+				}
+				fmt.Fprint(stdout, prefix+line)
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	os.Stdout = w
+	err = fn()
+	os.Stdout = stdout
+	w.Close()
+	<-done
+	r.Close()
+	return err
+}
+
+// archiveTimestamp returns the modification time to be stored in an
+// archive for fd. Files with garbage in their date fields get the Unix
+// epoch.
+func archiveTimestamp(fd oberon.FileDesc) time.Time {
+	if !fd.ValidTimestamp() {
+		return time.Unix(0, 0)
+	}
+	return fd.Timestamp()
+}
+
+// writeTar writes all files of fl to w as a tar archive.
+func writeTar(fl *oberon.Floppy, w io.Writer, text bool) error {
+	fds, err := fl.ListFiles()
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(w)
+	for _, fd := range fds {
+		data, err := fl.ReadFile(fd)
+		if err != nil {
+			return fmt.Errorf("%s: %w", fd.Name(), err)
+		}
+		if text {
+			data = oberon.TextToUTF8(data)
+		}
+		name, err := safeName(fd.Name())
+		if err != nil {
+			return err
+		}
+		hdr := &tar.Header{
+			Name:    name,
+			Mode:    0666,
+			Size:    int64(len(data)),
+			ModTime: archiveTimestamp(fd),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// writeZip writes all files of fl to a zip archive called filename.
+func writeZip(fl *oberon.Floppy, filename string, text bool) error {
+	fds, err := fl.ListFiles()
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	for _, fd := range fds {
+		data, err := fl.ReadFile(fd)
+		if err != nil {
+			return fmt.Errorf("%s: %w", fd.Name(), err)
+		}
+		if text {
+			data = oberon.TextToUTF8(data)
+		}
+		name, err := safeName(fd.Name())
+		if err != nil {
+			return err
+		}
+		hdr := &zip.FileHeader{
+			Name:     name,
+			Method:   zip.Deflate,
+			Modified: archiveTimestamp(fd),
+		}
+		w, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// commandAliases maps the short forms of commands to their names.
+var commandAliases = map[string]string{
+	"l":  "list",
+	"d":  "dump",
+	"x":  "extract",
+	"xa": "extractall",
+}
+
+// commandName returns the name of command, which may be a short form.
+func commandName(command string) string {
+	if name, found := commandAliases[command]; found {
+		return name
+	}
+	return command
+}
+
+// commandHelpText is the help printed by "cft <image file> <command> -help".
+type commandHelpText struct {
+	syntax      string
+	description string
+	example     string
+}
+
+// commandOrder is the order in which printUsage lists the commands of
+// commandHelp.
+var commandOrder = []string{
+	"list", "find", "csv", "count", "dump", "extract", "extract-index", "get", "extractall",
+	"hexdump", "raw", "tar", "zip", "sha256", "fingerprint", "diff", "info", "shell",
+	"check", "fsck", "chain", "entry", "fat", "slack", "undelete", "add", "rename", "touch", "rm",
+}
+
+var commandHelp = map[string]commandHelpText{
+	"list": {
+		"list (l) [flags]",
+		"List all files, preceded by the volume label and followed by a summary of the free space.",
+		"list -sort size -reverse -h",
+	},
+	"find": {
+		"find <substring>",
+		"List all files whose names contain <substring>, ignoring case.",
+		"find kernel",
+	},
+	"csv": {
+		"csv",
+		"List all files as CSV, with the columns name, size, timestamp and head.",
+		"csv > files.csv",
+	},
+	"count": {
+		"count [flags]",
+		"Print the number of files on the floppy.",
+		"count -deleted",
+	},
+	"dump": {
+		"dump (d) [flags] <pattern>",
+		"Write all files matching the shell pattern <pattern> to stdout.",
+		"dump -text -sep '\\n' '*.Text'",
+	},
+	"extract": {
+		"extract (x) [flags] <pattern>...",
+		"Copy all files matching the shell patterns to the current directory.",
+		"extract -o src '*.Mod'",
+	},
+	"extract-index": {
+		"extract-index [flags] <n>",
+		"Copy the <n>th file of the listing (see list -l) to the current directory.",
+		"extract-index 3",
+	},
+	"get": {
+		"get [flags] <filename> <localpath>",
+		"Copy file <filename> to <localpath>, preserving its timestamp.",
+		"get -text Kernel.Mod src/kernel.mod",
+	},
+	"extractall": {
+		"extractall (xa) [flags]",
+		"Copy all files to the current directory.",
+		"extractall -o disk1 -manifest",
+	},
+	"hexdump": {
+		"hexdump [flags] <filename>",
+		"Print a hex dump of file <filename>, in the same format as hexdump -C.",
+		"hexdump Kernel.Obj",
+	},
+	"raw": {
+		"raw boot | fat | dir | <block>",
+		"Write the boot sector, the FAT, the directory or the 512 byte block <block> to stdout.",
+		"raw dir > dir.bin",
+	},
+	"tar": {
+		"tar [flags]",
+		"Write all files to stdout as a tar archive.",
+		"tar > floppy.tar",
+	},
+	"zip": {
+		"zip [flags] <zipfile>",
+		"Write all files to the zip archive <zipfile>.",
+		"zip -text floppy.zip",
+	},
+	"sha256": {
+		"sha256 <filename> | -all",
+		"Print the SHA-256 hash of file <filename>, or of all files, like sha256sum.",
+		"sha256 -all",
+	},
+	"fingerprint": {
+		"fingerprint",
+		"Print the SHA-256 hash of the whole image, its size and its number of files.",
+		"fingerprint",
+	},
+	"diff": {
+		"diff [flags] <image file>",
+		"List the files added (+), removed (-) or changed (M) in <image file>.",
+		"diff new.img",
+	},
+	"info": {
+		"info",
+		"Print information about the floppy, such as the volume label and the free space.",
+		"info",
+	},
+	"shell": {
+		"shell",
+		"Read commands from stdin and run them, until quit.",
+		"shell",
+	},
+	"check": {
+		"check [flags]",
+		"Check that the directory and all files can be read. The exit status is 1 if not.",
+		"check",
+	},
+	"fsck": {
+		"fsck [flags]",
+		"Check the directory entries against the FAT, and print every problem found.",
+		"fsck",
+	},
+	"chain": {
+		"chain <filename>",
+		"Print the FAT blocks occupied by file <filename>.",
+		"chain Kernel.Mod",
+	},
+	"entry": {
+		"entry <filename>",
+		"Print the 32 bytes of the directory entry of file <filename>, and the fields decoded from them.",
+		"entry Kernel.Mod",
+	},
+	"fat": {
+		"fat",
+		"Print the FAT, 16 entries per line.",
+		"fat",
+	},
+	"slack": {
+		"slack",
+		"Print the number of unused bytes in the last block of every file.",
+		"slack",
+	},
+	"undelete": {
+		"undelete <filename>",
+		"Recover deleted file <filename> to the current directory. Any character matches the first one of the name.",
+		"undelete ?ernel.Mod",
+	},
+	"add": {
+		"add <localfile> [<filename>]",
+		"Copy <localfile> to the floppy, as <filename> if given.",
+		"add kernel.mod Kernel.Mod",
+	},
+	"rename": {
+		"rename <oldname> <newname>",
+		"Rename file <oldname> on the floppy to <newname>.",
+		"rename Kernel.Mod Kernel.Bak",
+	},
+	"touch": {
+		"touch [flags] <filename> [<time>]",
+		"Set the timestamp of file <filename> to <time> (RFC 3339), or to now.",
+		"touch Kernel.Mod 1990-05-17T14:23:42Z",
+	},
+	"rm": {
+		"rm <filename>",
+		"Delete file <filename> from the floppy.",
+		"rm Kernel.Bak",
+	},
+}
+
+// printCommandHelp prints the help of command name. fs holds the command's
+// flags, it is nil if the command has none.
+func printCommandHelp(name string, fs *flag.FlagSet) error {
+	help := commandHelp[name]
+	fmt.Printf("Usage: cft <image file> %s\n", help.syntax)
+	fmt.Printf("%s\n", help.description)
+	if fs != nil {
+		fmt.Printf("Flags:\n")
+		fs.SetOutput(os.Stdout)
+		fs.PrintDefaults()
+	}
+	fmt.Printf("Example: cft floppy.img %s\n", help.example)
+	return nil
+}
+
+func printUsage() error {
+	fmt.Printf("Usage: cft [-config <file>] [-v] [-tz <zone>] [-mmap] [-strict] [-ignore-label] [-any-media] [-dir-start <block>] [-dir-end <block>] <image file> command [command params]\n")
+	fmt.Printf("       cft [-config <file>] [-v] [-tz <zone>] [-mmap] -images <image file>,... list\n")
+	fmt.Printf("       cft [-config <file>] [-v] [-tz <zone>] [-mmap] batch <dir> command [command params]\n")
+	fmt.Printf("       cft [-config <file>] [-v] [-tz <zone>] [-mmap] diff [-no-content] <image file> <image file>\n")
+	fmt.Printf("Default flags are read from <file>, or from ~/.cftrc\n")
+	fmt.Printf("With -v, the details of parsing the image are logged to stderr\n")
+	fmt.Printf("With -tz, timestamps are in time zone <zone> (e.g. UTC) instead of the local one\n")
+	fmt.Printf("With -mmap, the image is memory mapped instead of read completely\n")
+	fmt.Printf("With -strict, commands fail if the boot sector or the FAT are inconsistent\n")
+	fmt.Printf("With -ignore-label, the directory is read even if it doesn't start with a valid volume label\n")
+	fmt.Printf("With -any-media, the floppy is read even if its media descriptor is neither 0xf9 nor 0xe9\n")
+	fmt.Printf("With -dir-start and -dir-end, the directory is read from blocks <block> to <block>-1 (7 and 14 on 720K floppies)\n")
+	fmt.Printf("With -images, batch and diff, -strict, -ignore-label, -any-media, -dir-start and -dir-end apply to every image\n")
+	fmt.Printf("Use - as <image file> to read the image from stdin\n")
+	fmt.Printf("Available commands are: (short form in parentheses, use <command> -help for details)\n")
+	for _, name := range commandOrder {
+		help := commandHelp[name]
+		fmt.Printf("  %s: %s\n", help.syntax, strings.TrimSuffix(help.description, "."))
+	}
+	fmt.Printf("With -text, dump, extract, extract-index and extractall convert Oberon text to UTF-8\n")
+	fmt.Printf("With -report, they print the number of converted line ends and characters of every file to stderr\n")
+	fmt.Printf("With -i, dump and extract ignore the case of file names\n")
+	fmt.Printf("With -n or -dry-run, extract, extract-index and extractall only print the files they would write\n")
+	fmt.Printf("Existing files are only overwritten by extract, extract-index and extractall with -force\n")
 	return nil
 }
 
@@ -344,10 +2363,11 @@ func main() {
 	if err != nil {
 		fmt.Printf("%s\n", err)
 		printUsage()
-		return
+		os.Exit(2)
 	}
 	err = cmd()
 	if err != nil {
 		fmt.Printf("Error while executing command: %s\n", err)
+		os.Exit(1)
 	}
 }
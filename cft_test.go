@@ -0,0 +1,379 @@
+/*
+ * Copyright (c) 2023 Andreas Signer <asigner@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by the
+ * Free Software Foundation, either version 3 of the License, or (at your
+ * option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+ * for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/asig/ceres_floppy_tool/oberon"
+)
+
+const (
+	testBlockSize = 512
+	testDirBlock  = 7
+)
+
+var testTime = time.Date(1990, 5, 17, 14, 23, 42, 0, time.UTC)
+
+func TestMain(m *testing.M) {
+	oberon.SetLocation(time.UTC)
+	os.Exit(m.Run())
+}
+
+// testFile is a file stored on the floppy returned by newTestFloppy.
+type testFile struct {
+	name string
+	data []byte
+}
+
+// newTestFloppy returns an empty 720K Oberon floppy with the given files
+// added, and its image. Changes to the image are seen by the floppy.
+func newTestFloppy(t *testing.T, files ...testFile) (*oberon.Floppy, []byte) {
+	t.Helper()
+	img := make([]byte, 1440*testBlockSize)
+	img[21] = 0xf9 // media descriptor
+	label := img[testDirBlock*testBlockSize:]
+	copy(label[1:11], "TESTDISK  ")
+	label[11] = 8
+	fl, err := oberon.OpenBytes(img)
+	if err != nil {
+		t.Fatalf("OpenBytes: %v", err)
+	}
+	for _, f := range files {
+		if err := fl.AddFile(f.name, f.data, testTime); err != nil {
+			t.Fatalf("AddFile(%q): %v", f.name, err)
+		}
+	}
+	return fl, img
+}
+
+// testFileDesc returns the directory entry of the file called name.
+func testFileDesc(t *testing.T, fl *oberon.Floppy, name string) oberon.FileDesc {
+	t.Helper()
+	fds, err := fl.ListFiles()
+	if err != nil {
+		t.Fatalf("ListFiles: %v", err)
+	}
+	for _, fd := range fds {
+		if fd.Name() == name {
+			return fd
+		}
+	}
+	t.Fatalf("%s not found on the floppy", name)
+	return oberon.FileDesc{}
+}
+
+func TestExtractEmptyFile(t *testing.T) {
+	tests := []struct {
+		name         string
+		clearTime    bool // clear the date and time fields of the entry
+		wantModified time.Time
+	}{
+		{"Empty.Bak", false, testTime},
+		{"NoDate.Bak", true, time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fl, img := newTestFloppy(t, testFile{tt.name, nil})
+			if tt.clearTime {
+				// The first file's entry follows the volume label
+				entry := img[testDirBlock*testBlockSize+32:]
+				clear(entry[22:26])
+			}
+			dir := t.TempDir()
+			fd := testFileDesc(t, fl, tt.name)
+			if _, err := extractFile(fl, fd, extractOptions{outDir: dir}); err != nil {
+				t.Fatalf("extractFile: %v", err)
+			}
+			fi, err := os.Stat(filepath.Join(dir, tt.name))
+			if err != nil {
+				t.Fatalf("extracted file missing: %v", err)
+			}
+			if fi.Size() != 0 {
+				t.Errorf("extracted file has %d bytes, want 0", fi.Size())
+			}
+			if !tt.wantModified.IsZero() && !fi.ModTime().Equal(tt.wantModified) {
+				t.Errorf("extracted file modified at %v, want %v", fi.ModTime(), tt.wantModified)
+			}
+		})
+	}
+}
+
+func TestExtractExistingFile(t *testing.T) {
+	tests := []struct {
+		name  string
+		force bool
+		want  string
+	}{
+		{"without force", false, "local"},
+		{"with force", true, "floppy"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fl, _ := newTestFloppy(t, testFile{"Kernel.Mod", []byte("floppy")})
+			dir := t.TempDir()
+			dest := filepath.Join(dir, "Kernel.Mod")
+			if err := os.WriteFile(dest, []byte("local"), 0666); err != nil {
+				t.Fatal(err)
+			}
+			fd := testFileDesc(t, fl, "Kernel.Mod")
+			if _, err := extractFile(fl, fd, extractOptions{outDir: dir, force: tt.force}); err != nil {
+				t.Fatalf("extractFile: %v", err)
+			}
+			data, err := os.ReadFile(dest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.want {
+				t.Errorf("%s contains %q, want %q", dest, data, tt.want)
+			}
+		})
+	}
+}
+
+func TestCommandOrder(t *testing.T) {
+	seen := make(map[string]bool)
+	for _, name := range commandOrder {
+		if _, found := commandHelp[name]; !found {
+			t.Errorf("%s is in commandOrder, but has no help", name)
+		}
+		if seen[name] {
+			t.Errorf("%s is listed twice in commandOrder", name)
+		}
+		seen[name] = true
+	}
+	for name := range commandHelp {
+		if !seen[name] {
+			t.Errorf("%s has help, but is missing from commandOrder", name)
+		}
+	}
+}
+
+func TestExtractAllSplitDots(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []testFile
+		want  map[string]string // extracted files and their contents
+	}{
+		{
+			"split",
+			[]testFile{{"Kernel.Mod", []byte("module")}, {"Oberon.Text", []byte("text")}},
+			map[string]string{"Kernel/Mod": "module", "Oberon/Text": "text"},
+		},
+		{
+			"file first",
+			[]testFile{{"Kernel", []byte("file")}, {"Kernel.Mod", []byte("module")}},
+			map[string]string{"Kernel": "file", "Kernel.Mod": "module"},
+		},
+		{
+			"directory first",
+			[]testFile{{"Kernel.Mod", []byte("module")}, {"Kernel", []byte("file")}, {"Oberon.Text", []byte("text")}},
+			map[string]string{"Kernel/Mod": "module", "Kernel_": "file", "Oberon/Text": "text"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fl, _ := newTestFloppy(t, tt.files...)
+			dir := t.TempDir()
+			cmd, err := parseCommand(fl, "test.img", oberon.Open, floppySetup{dirStart: -1, dirEnd: -1}, []string{"test.img", "extractall", "-q", "-split-dots", "-manifest", "-o", dir})
+			if err != nil {
+				t.Fatalf("parseCommand: %v", err)
+			}
+			if err := cmd(); err != nil {
+				t.Fatalf("extractall: %v", err)
+			}
+			got := make(map[string]string)
+			err = filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+				if err != nil || d.IsDir() || d.Name() == "manifest.json" {
+					return err
+				}
+				data, err := os.ReadFile(path)
+				rel, _ := filepath.Rel(dir, path)
+				got[filepath.ToSlash(rel)] = string(data)
+				return err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("extracted %v, want %v", got, tt.want)
+			}
+
+			// The manifest names the files actually written
+			data, err := os.ReadFile(filepath.Join(dir, "manifest.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var entries []manifestEntry
+			if err := json.Unmarshal(data, &entries); err != nil {
+				t.Fatal(err)
+			}
+			inManifest := make(map[string]bool)
+			for _, e := range entries {
+				inManifest[filepath.ToSlash(e.File)] = true
+			}
+			for file := range tt.want {
+				if !inManifest[file] {
+					t.Errorf("manifest %s doesn't list %s", data, file)
+				}
+			}
+			if len(entries) != len(tt.want) {
+				t.Errorf("manifest lists %d files, want %d", len(entries), len(tt.want))
+			}
+		})
+	}
+}
+
+func TestDiffAppliesSetup(t *testing.T) {
+	tests := []struct {
+		name        string
+		ignoreLabel bool
+		wantErr     bool
+	}{
+		{"checked", false, true},
+		{"ignore label", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fl, _ := newTestFloppy(t, testFile{"Kernel.Mod", []byte("module")})
+			_, other := newTestFloppy(t, testFile{"Kernel.Mod", []byte("module")})
+			other[testDirBlock*testBlockSize+11] = 0 // not a volume label
+			otherFile := filepath.Join(t.TempDir(), "other.img")
+			if err := os.WriteFile(otherFile, other, 0666); err != nil {
+				t.Fatal(err)
+			}
+			setup := floppySetup{ignoreLabel: tt.ignoreLabel, dirStart: -1, dirEnd: -1}
+			cmd, err := parseCommand(fl, "test.img", oberon.Open, setup, []string{"test.img", "diff", otherFile})
+			if err != nil {
+				t.Fatalf("parseCommand: %v", err)
+			}
+			if err := cmd(); (err != nil) != tt.wantErr {
+				t.Errorf("diff = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestExtractAllBrokenChain(t *testing.T) {
+	tests := []struct {
+		name   string
+		broken []byte // FAT entry 2, the first block of Kernel.Mod, packed
+		want   []string
+	}{
+		{"intact", nil, []string{"Kernel.Mod", "Last.Mod", "Oberon.Text"}},
+		{"ends early", []byte{0xff, 0x0f}, []string{"Kernel.Mod.partial", "Last.Mod", "Oberon.Text"}},
+		{"links to a free block", []byte{0x10, 0x00}, []string{"Kernel.Mod.partial", "Last.Mod", "Oberon.Text"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, img := newTestFloppy(t,
+				testFile{"Kernel.Mod", make([]byte, 3000)},
+				testFile{"Oberon.Text", []byte("text")},
+				testFile{"Last.Mod", []byte("module")})
+			if tt.broken != nil {
+				fat := img[testBlockSize+3:]
+				fat[0] = tt.broken[0]
+				fat[1] = fat[1]&0xf0 | tt.broken[1]
+			}
+			fl, err := oberon.OpenBytes(img)
+			if err != nil {
+				t.Fatalf("OpenBytes: %v", err)
+			}
+			dir := t.TempDir()
+			cmd, err := parseCommand(fl, "test.img", oberon.Open, floppySetup{dirStart: -1, dirEnd: -1}, []string{"test.img", "extractall", "-q", "-o", dir})
+			if err != nil {
+				t.Fatalf("parseCommand: %v", err)
+			}
+			err = cmd()
+			if tt.broken == nil && err != nil {
+				t.Errorf("extractall: %v", err)
+			}
+			if tt.broken != nil && (!errors.Is(err, oberon.ErrTruncated) || !strings.Contains(err.Error(), "Kernel.Mod")) {
+				t.Errorf("extractall = %v, want a truncation error naming Kernel.Mod", err)
+			}
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, e := range entries {
+				got = append(got, e.Name())
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("extracted %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// captureStdout returns what fn writes to stdout.
+func captureStdout(t *testing.T, fn func() error) (string, error) {
+	t.Helper()
+	f, err := os.CreateTemp(t.TempDir(), "stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	stdout := os.Stdout
+	os.Stdout = f
+	err = fn()
+	os.Stdout = stdout
+	data, readErr := os.ReadFile(f.Name())
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	return string(data), err
+}
+
+func TestCommandHelp(t *testing.T) {
+	tests := []struct {
+		args []string
+		want string // first line of the output
+	}{
+		{[]string{"list", "-help"}, "Usage: cft <image file> list (l) [flags]"},
+		{[]string{"list", "-l", "-help"}, "Usage: cft <image file> list (l) [flags]"},
+		{[]string{"l", "-q", "--help"}, "Usage: cft <image file> list (l) [flags]"},
+		{[]string{"xa", "-q", "-o", "out", "-h"}, "Usage: cft <image file> extractall (xa) [flags]"},
+		{[]string{"diff", "-no-content", "-help"}, "Usage: cft <image file> diff [flags] <image file>"},
+		{[]string{"chain", "-help"}, "Usage: cft <image file> chain <filename>"},
+		{[]string{"list", "-h", "-q"}, "Kernel.Mod"},
+	}
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.args, " "), func(t *testing.T) {
+			fl, _ := newTestFloppy(t, testFile{"Kernel.Mod", []byte("module")})
+			cmd, err := parseCommand(fl, "test.img", oberon.Open, floppySetup{dirStart: -1, dirEnd: -1}, append([]string{"test.img"}, tt.args...))
+			if err != nil {
+				t.Fatalf("parseCommand: %v", err)
+			}
+			out, err := captureStdout(t, cmd)
+			if err != nil {
+				t.Fatalf("command failed: %v", err)
+			}
+			if first, _, _ := strings.Cut(out, "\n"); first != tt.want {
+				t.Errorf("first line of the output = %q, want %q", first, tt.want)
+			}
+		})
+	}
+}
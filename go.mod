@@ -0,0 +1,3 @@
+module github.com/asig/ceres_floppy_tool
+
+go 1.21
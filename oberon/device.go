@@ -0,0 +1,73 @@
+/*
+ * Copyright (c) 2023 Andreas Signer <asigner@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by the
+ * Free Software Foundation, either version 3 of the License, or (at your
+ * option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+ * for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package oberon
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// deviceChunkSize is the number of bytes read from a device at once. Some
+// devices only support reads of whole blocks.
+const deviceChunkSize = 64 * blockSize
+
+// readImage reads the image stored in filename. device is true if filename
+// is a device rather than a regular file.
+func readImage(filename string) (img []byte, device bool, err error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, false, err
+	}
+	if fi.Mode()&os.ModeDevice == 0 {
+		img, err = io.ReadAll(f)
+		return img, false, err
+	}
+	img, err = readDevice(f)
+	return img, true, err
+}
+
+// readDevice reads all blocks of the device f. Stat doesn't know the size
+// of devices, so it is determined by seeking to the end, if possible.
+func readDevice(f *os.File) ([]byte, error) {
+	var img []byte
+	if size, err := f.Seek(0, io.SeekEnd); err == nil && size > 0 {
+		img = make([]byte, 0, size)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, deviceChunkSize)
+	for {
+		n, err := f.Read(buf)
+		img = append(img, buf[:n]...)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot read block %d: %w", len(img)/blockSize, err)
+		}
+	}
+	return img, nil
+}
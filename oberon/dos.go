@@ -0,0 +1,146 @@
+/*
+ * Copyright (c) 2023 Andreas Signer <asigner@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by the
+ * Free Software Foundation, either version 3 of the License, or (at your
+ * option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+ * for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package oberon
+
+import "bytes"
+
+// MS-DOS floppies use the same layout as Oberon floppies, only the
+// directory entries differ.
+
+const (
+	dosAttrVolumeLabel = 0x08
+	dosAttrDirectory   = 0x10
+	dosAttrLongName    = 0x0f
+)
+
+// IsDOS reports whether the floppy is MS-DOS formatted rather than Oberon
+// formatted.
+func (fl *Floppy) IsDOS() bool {
+	buf, err := fl.getBlock(fl.geo.dirStart)
+	if err != nil {
+		return false
+	}
+	fd := fileDescFromBytes(buf, 0)
+	if fd.name[11] == 8 && (fd.name[0] == 0 || fd.name[0] >= 0xe5) {
+		// Oberon volume label
+		return false
+	}
+	// DOS boot sectors start with a jump and have 512 bytes per sector
+	boot := fl.img
+	return (boot[0] == 0xeb || boot[0] == 0xe9) && boot[11] == 0 && boot[12] == 2
+}
+
+func dosFileDescFromBytes(buf []byte, ofs int) FileDesc {
+	fd := fileDescFromBytes(buf, ofs)
+	// Only the first 11 bytes are the name, the rest are attributes
+	base := ofs * fileDescSize
+	fd.name = [maxFilenameLen]byte{}
+	copy(fd.name[:], dosName(buf[base:base+11]))
+	fd.dos = true
+	return fd
+}
+
+// dosName returns the dotted form of the 8.3 name raw, which is stored as
+// 8 characters of the name and 3 of the extension, both padded with
+// blanks. As 0xe5 marks deleted entries, names starting with the
+// character 0xe5 are stored with 0x05 instead.
+func dosName(raw []byte) []byte {
+	name := bytes.TrimRight(raw[:8], " ")
+	ext := bytes.TrimRight(raw[8:11], " ")
+	res := bytes.Clone(name)
+	if len(res) > 0 && res[0] == 0x05 {
+		res[0] = 0xe5
+	}
+	if len(ext) > 0 {
+		res = append(append(res, '.'), ext...)
+	}
+	return res
+}
+
+// forEachDOSFile calls fn for every file in the root directory of an
+// MS-DOS floppy. Unlike on Oberon floppies, the directory can have holes.
+func (fl *Floppy) forEachDOSFile(fn func(FileDesc) error) error {
+	for s := fl.geo.dirStart; s < fl.geo.dirEnd; s++ {
+		buf, err := fl.getBlock(s)
+		if err != nil {
+			return err
+		}
+		for j := 0; j < dirEntriesPerBlock; j++ {
+			base := j * fileDescSize
+			attr := buf[base+11]
+			switch {
+			case buf[base] == 0:
+				// end of directory
+				return nil
+			case buf[base] == 0xe5:
+				// deleted
+			case attr == dosAttrLongName, attr&(dosAttrVolumeLabel|dosAttrDirectory) != 0:
+				// not a file
+			default:
+				if err := fn(dosFileDescFromBytes(buf, j)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// dosFreeDirEntries returns the number of unused and deleted entries in the
+// root directory of an MS-DOS floppy. All entries after the end of the
+// directory are unused.
+func (fl *Floppy) dosFreeDirEntries() (int, error) {
+	free := 0
+	end := false
+	for s := fl.geo.dirStart; s < fl.geo.dirEnd; s++ {
+		buf, err := fl.getBlock(s)
+		if err != nil {
+			return 0, err
+		}
+		for j := 0; j < dirEntriesPerBlock; j++ {
+			first := buf[j*fileDescSize]
+			end = end || first == 0
+			if end || first == 0xe5 {
+				free++
+			}
+		}
+	}
+	return free, nil
+}
+
+// dosVolumeLabel returns the label of an MS-DOS floppy, or "" if it has
+// none.
+func (fl *Floppy) dosVolumeLabel() (string, error) {
+	for s := fl.geo.dirStart; s < fl.geo.dirEnd; s++ {
+		buf, err := fl.getBlock(s)
+		if err != nil {
+			return "", err
+		}
+		for j := 0; j < dirEntriesPerBlock; j++ {
+			base := j * fileDescSize
+			attr := buf[base+11]
+			if buf[base] == 0 {
+				return "", nil
+			}
+			if buf[base] != 0xe5 && attr != dosAttrLongName && attr&dosAttrVolumeLabel != 0 {
+				return string(bytes.TrimRight(buf[base:base+11], " ")), nil
+			}
+		}
+	}
+	return "", nil
+}
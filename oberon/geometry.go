@@ -0,0 +1,102 @@
+/*
+ * Copyright (c) 2023 Andreas Signer <asigner@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by the
+ * Free Software Foundation, either version 3 of the License, or (at your
+ * option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+ * for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package oberon
+
+import "fmt"
+
+// geometry describes where the FAT, the directory and the data are
+// located on a floppy.
+type geometry struct {
+	fatStart, fatBlocks int32 // first block and number of blocks of the FAT
+	fatCopies           int32 // number of copies of the FAT, stored one after the other
+	dirStart, dirEnd    int32 // the directory occupies blocks dirStart to dirEnd-1
+	dataStart           int32 // first block of FAT block 2
+	blocksPerCluster    int32 // number of blocks per FAT block
+}
+
+// The layout of 720K floppies. It is the same for Oberon and MS-DOS. FAT
+// blocks 0 and 1 are reserved, so FAT block i starts at block
+// dataStartBlock+(i-2)*blocksPerCluster = 10+2*i: although the formula
+// contains a 10, the data never overlaps the directory in blocks 7 to 13.
+const (
+	fatStartBlock    = 1
+	fatBlockCount    = 3
+	fatCopyCount     = 2 // the second copy is in blocks 4 to 6
+	dirStartBlock    = 7
+	dirEndBlock      = 14 // first block after the directory
+	dataStartBlock   = 14 // first block of FAT block 2
+	blocksPerCluster = 2
+)
+
+// defaultGeometry is the layout of 720K floppies.
+var defaultGeometry = geometry{
+	fatStart:         fatStartBlock,
+	fatBlocks:        fatBlockCount,
+	fatCopies:        fatCopyCount,
+	dirStart:         dirStartBlock,
+	dirEnd:           dirEndBlock,
+	dataStart:        dataStartBlock,
+	blocksPerCluster: blocksPerCluster,
+}
+
+// detectGeometry reads the geometry from the BIOS parameter block in the
+// boot sector. If the boot sector does not contain a plausible one, the
+// 720K layout is assumed.
+func detectGeometry(boot []byte) geometry {
+	le16 := func(ofs int) int32 {
+		return int32(boot[ofs+1])<<8 | int32(boot[ofs])
+	}
+	bytesPerSector := le16(11)
+	sectorsPerCluster := int32(boot[13])
+	reserved := le16(14)
+	fats := int32(boot[16])
+	rootEntries := le16(17)
+	sectorsPerFAT := le16(22)
+	if bytesPerSector != blockSize || sectorsPerCluster == 0 || reserved == 0 || fats == 0 ||
+		sectorsPerFAT == 0 || rootEntries == 0 || rootEntries%dirEntriesPerBlock != 0 {
+		return defaultGeometry
+	}
+
+	g := geometry{
+		fatStart:         reserved,
+		fatBlocks:        sectorsPerFAT,
+		fatCopies:        fats,
+		dirStart:         reserved + fats*sectorsPerFAT,
+		blocksPerCluster: sectorsPerCluster,
+	}
+	g.dirEnd = g.dirStart + rootEntries/dirEntriesPerBlock
+	g.dataStart = g.dirEnd
+	return g
+}
+
+// check reports regions of the layout that overlap each other, which
+// only happens if the boot sector describes a nonsensical one.
+func (g geometry) check() error {
+	switch {
+	case g.fatStart+g.fatCopies*g.fatBlocks > g.dirStart:
+		return fmt.Errorf("FAT (blocks %d-%d) overlaps the directory (from block %d)", g.fatStart, g.fatStart+g.fatCopies*g.fatBlocks-1, g.dirStart)
+	case g.dirEnd > g.dataStart:
+		return fmt.Errorf("directory (blocks %d-%d) overlaps the data (from block %d)", g.dirStart, g.dirEnd-1, g.dataStart)
+	}
+	return nil
+}
+
+// clusterStart returns the first block of FAT block i.
+func (g geometry) clusterStart(i int32) int32 {
+	return g.dataStart + (i-2)*g.blocksPerCluster
+}
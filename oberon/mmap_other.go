@@ -0,0 +1,35 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+/*
+ * Copyright (c) 2023 Andreas Signer <asigner@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by the
+ * Free Software Foundation, either version 3 of the License, or (at your
+ * option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+ * for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package oberon
+
+import (
+	"io"
+	"os"
+)
+
+// mapFile reads the first size bytes of f, as memory mapping is not
+// supported on this platform.
+func mapFile(f *os.File, size int) (img []byte, unmap func() error, err error) {
+	img = make([]byte, size)
+	if _, err := io.ReadFull(f, img); err != nil {
+		return nil, nil, err
+	}
+	return img, func() error { return nil }, nil
+}
@@ -0,0 +1,1262 @@
+/*
+ * Copyright (c) 2023 Andreas Signer <asigner@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by the
+ * Free Software Foundation, either version 3 of the License, or (at your
+ * option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+ * for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package oberon reads floppy disk images written by the Oberon system
+// running on a Ceres workstation.
+package oberon
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	blockSize          = 512
+	maxFilenameLen     = 22
+	fileDescSize       = 32
+	dirEntriesPerBlock = blockSize / fileDescSize
+
+	// labelEntries is the number of entries at the start of an Oberon
+	// directory that hold the volume label instead of files.
+	labelEntries = 1
+)
+
+var (
+	errImageTooSmall = errors.New("image too small to be a floppy")
+	errMSDOSReadOnly = errors.New("MS-DOS floppies can't be modified")
+
+	errCompressedReadOnly = errors.New("compressed images can't be modified")
+	errDeviceReadOnly     = errors.New("floppies in a drive can't be modified")
+)
+
+// Errors returned by the package. They are usually wrapped with details,
+// use errors.Is to check for them.
+var (
+	ErrNotOberon      = errors.New("Neither Oberon nor MSDOS formatted diskette")
+	ErrBadVolumeLabel = errors.New("invalid volume label")
+	ErrFileNotFound   = errors.New("file not found")
+	ErrFileExists     = errors.New("file exists already")
+	ErrDirectoryFull  = errors.New("directory is full")
+	ErrNoSpace        = errors.New("not enough free space on floppy")
+	ErrTruncated      = errors.New("file truncated")
+)
+
+// logger receives the details of parsing the image. It discards them
+// unless SetLogOutput is called.
+var logger = log.New(io.Discard, "", 0)
+
+// SetLogOutput makes the package log the details of parsing images to w,
+// which helps diagnosing broken images.
+func SetLogOutput(w io.Writer) {
+	logger.SetOutput(w)
+}
+
+// location is the time zone the timestamps on the floppy are interpreted
+// in. Floppies don't record it, so it defaults to the local one.
+var location = time.Local
+
+// SetLocation sets the time zone the timestamps on floppies are
+// interpreted in. A nil loc selects UTC.
+func SetLocation(loc *time.Location) {
+	if loc == nil {
+		// time.Date panics on a nil location
+		loc = time.UTC
+	}
+	location = loc
+}
+
+// Location returns the time zone the timestamps on floppies are
+// interpreted in.
+func Location() *time.Location {
+	return location
+}
+
+// ---------------------------------
+// FileDesc
+// ---------------------------------
+
+// FileDesc is a directory entry of a file stored on the floppy.
+type FileDesc struct {
+	name       [maxFilenameLen]byte
+	time, date int16
+	head       int16
+	size       int32
+	dos        bool // MS-DOS directory entry
+	deleted    bool
+
+	raw [fileDescSize]byte // the entry as read from the directory
+}
+
+// Name returns the file's name. The first character of a deleted file's
+// name is lost, it is returned as '?'.
+func (fd *FileDesc) Name() string {
+	i := 0
+	for i < maxFilenameLen && fd.name[i] != 0 {
+		i++
+	}
+	if fd.deleted {
+		return "?" + string(fd.name[1:i])
+	}
+	return string(fd.name[:i])
+}
+
+// Raw returns the 32 bytes of the directory entry as read from the
+// directory: The name in bytes 0-21, followed by the time, the date, the
+// head and the size.
+func (fd *FileDesc) Raw() []byte {
+	return bytes.Clone(fd.raw[:])
+}
+
+// Deleted reports whether the file has been deleted.
+func (fd *FileDesc) Deleted() bool {
+	return fd.deleted
+}
+
+// Size returns the file's size in bytes.
+func (fd *FileDesc) Size() int32 {
+	return fd.size
+}
+
+// Head returns the index of the file's first block in the FAT.
+func (fd *FileDesc) Head() int16 {
+	return fd.head
+}
+
+// Timestamp returns the file's modification time.
+func (fd *FileDesc) Timestamp() time.Time {
+	// Oberon date and time format, according to "The Oberon System: User Guide and Programmer's Manual" by Martin Reiser
+	// Date: 7 bits year, 4 bits month, 5 bits day
+	// Time: 5 bits hour, 6 bits minute, 6 bits seconds.
+	//
+	// On floppy disks, the lowest bit of seconds is dropped
+
+	// MS-DOS uses the same format, but counts the years from 1980
+	yearBase := 1900
+	if fd.dos {
+		yearBase = 1980
+	}
+	y := yearBase + int(fd.date>>9&0x7f)
+	m := time.Month(fd.date >> 5 & 0xf)
+	d := int(fd.date & 0x1f)
+
+	hh := int(fd.time >> 11 & 0x1f)
+	mm := int(fd.time >> 5 & 0x3f)
+	// The 5 stored bits are seconds/2, so they can encode 60 and 62, which
+	// a clean disk never contains. Clamp them instead of rolling over into
+	// the next minute.
+	ss := min(int(fd.time&0x1f)*2, 59)
+
+	return time.Date(y, m, d, hh, mm, ss, 0, location)
+}
+
+// ValidTimestamp reports whether the file's date and time fields are in
+// range. If they are not, Timestamp returns a normalized, but meaningless
+// time.
+func (fd *FileDesc) ValidTimestamp() bool {
+	m := fd.date >> 5 & 0xf
+	d := fd.date & 0x1f
+	hh := fd.time >> 11 & 0x1f
+	mm := fd.time >> 5 & 0x3f
+	return m >= 1 && m <= 12 && d >= 1 && hh < 24 && mm < 60
+}
+
+// setTimestamp is the inverse of Timestamp.
+func (fd *FileDesc) setTimestamp(t time.Time) error {
+	t = t.In(location)
+	if t.Year() < 1900 || t.Year() > 1900+0x7f {
+		return fmt.Errorf("year %d can't be stored on a floppy", t.Year())
+	}
+	fd.date = int16((t.Year()-1900)<<9 | int(t.Month())<<5 | t.Day())
+	fd.time = int16(t.Hour()<<11 | t.Minute()<<5 | t.Second()/2)
+	return nil
+}
+
+func fileDescFromBytes(buf []byte, ofs int) FileDesc {
+	base := ofs * fileDescSize
+	var fd FileDesc
+	copy(fd.raw[:], buf[base:base+fileDescSize])
+	copy(fd.name[:], buf[base:base+maxFilenameLen])
+	fd.time = int16(buf[base+23])<<8 | int16(buf[base+22])
+	fd.date = int16(buf[base+25])<<8 | int16(buf[base+24])
+	fd.head = int16(buf[base+27])<<8 | int16(buf[base+26])
+	fd.size = int32(buf[base+31])<<24 | int32(buf[base+30])<<16 | int32(buf[base+29])<<8 | int32(buf[base+28])
+
+	return fd
+}
+
+func (fd *FileDesc) toBytes(buf []byte, ofs int) {
+	base := ofs * fileDescSize
+	copy(buf[base:base+maxFilenameLen], fd.name[:])
+	buf[base+22] = byte(fd.time)
+	buf[base+23] = byte(fd.time >> 8)
+	buf[base+24] = byte(fd.date)
+	buf[base+25] = byte(fd.date >> 8)
+	buf[base+26] = byte(fd.head)
+	buf[base+27] = byte(fd.head >> 8)
+	buf[base+28] = byte(fd.size)
+	buf[base+29] = byte(fd.size >> 8)
+	buf[base+30] = byte(fd.size >> 16)
+	buf[base+31] = byte(fd.size >> 24)
+}
+
+// ---------------------------------
+// Floppy
+// ---------------------------------
+
+// Floppy is an Oberon floppy disk image.
+type Floppy struct {
+	img   []byte
+	geo   geometry
+	fat   []int32
+	unmap func() error // releases img if it is memory mapped
+
+	// src is the image's source if it is read on demand. Block i of img
+	// has been read from it if loaded[i] is set.
+	src    io.ReaderAt
+	loaded []bool
+
+	ignoreLabel bool // scan the directory even if the volume label is invalid
+	anyMedia    bool // accept any media descriptor
+
+	compressed bool // the image was read from a gzip compressed file
+	device     bool // the image was read from a device
+}
+
+// BlockCount returns the number of 512 byte blocks in the image.
+func (fl *Floppy) BlockCount() int32 {
+	return int32(len(fl.img) / blockSize)
+}
+
+// Block returns a copy of block idx. An error is returned if the block is
+// not in the image.
+func (fl *Floppy) Block(idx int32) ([]byte, error) {
+	return fl.Blocks(idx, 1)
+}
+
+// Blocks returns a copy of the cnt blocks starting at block idx. An error
+// is returned if not all of them are in the image.
+func (fl *Floppy) Blocks(idx, cnt int32) ([]byte, error) {
+	buf, err := fl.getBlocks(idx, cnt)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.Clone(buf), nil
+}
+
+// CheckLayout reports whether the FAT, the directory and the data region
+// overlap each other.
+func (fl *Floppy) CheckLayout() error {
+	return fl.geo.check()
+}
+
+// StrictCheck performs checks of the format that ListFiles skips to be
+// able to read damaged floppies: The boot sector signature must be valid
+// if there is one (it is required on MS-DOS floppies), the reserved
+// entries 0 and 1 of the FAT must be set, and the regions of the layout
+// must not overlap.
+func (fl *Floppy) StrictCheck() error {
+	boot := fl.img[:blockSize]
+	sig := boot[510:512]
+	if (fl.IsDOS() || sig[0] != 0 || sig[1] != 0) && (sig[0] != 0x55 || sig[1] != 0xaa) {
+		return fmt.Errorf("invalid boot sector signature 0x%02x 0x%02x", sig[0], sig[1])
+	}
+	buf, err := fl.getBlock(fl.geo.fatStart)
+	if err != nil {
+		return err
+	}
+	// Entry 0 contains the media descriptor (Oberon uses 0xff), entry 1
+	// marks the end of a chain.
+	n := int32(buf[2])<<16 | int32(buf[1])<<8 | int32(buf[0])
+	e0, e1 := n%4096, n/4096
+	if (e0&0xff != int32(fl.MediaDescriptor()) && e0&0xff != 0xff) || e0>>8 != 0xf {
+		return fmt.Errorf("invalid reserved FAT entry 0 0x%03x", e0)
+	}
+	if e1 < 0xff8 {
+		return fmt.Errorf("invalid reserved FAT entry 1 0x%03x", e1)
+	}
+	return fl.CheckLayout()
+}
+
+// SetDirLocation overrides the location of the directory, for floppies
+// whose directory is not where the boot sector says. The directory then
+// occupies blocks first to end-1.
+func (fl *Floppy) SetDirLocation(first, end int32) error {
+	if first < 1 || end <= first || end > fl.BlockCount() {
+		return fmt.Errorf("invalid directory blocks %d-%d", first, end-1)
+	}
+	fl.geo.dirStart, fl.geo.dirEnd = first, end
+	return nil
+}
+
+// FATLocation returns the first block and the number of blocks of the FAT.
+func (fl *Floppy) FATLocation() (first, count int32) {
+	return fl.geo.fatStart, fl.geo.fatBlocks
+}
+
+// DirLocation returns the first block and the number of blocks of the
+// directory.
+func (fl *Floppy) DirLocation() (first, count int32) {
+	return fl.geo.dirStart, fl.geo.dirEnd - fl.geo.dirStart
+}
+
+func (fl *Floppy) getBlocks(idx, cnt int32) ([]byte, error) {
+	if cnt < 0 {
+		return nil, fmt.Errorf("invalid block count %d", cnt)
+	}
+	if idx < 0 || idx+cnt > fl.BlockCount() {
+		return nil, fmt.Errorf("block %d out of range (image has %d blocks)", idx+cnt-1, fl.BlockCount())
+	}
+	ofs := idx * blockSize
+	if fl.src != nil {
+		if err := fl.load(idx, cnt); err != nil {
+			return nil, err
+		}
+	}
+	return fl.img[ofs : ofs+cnt*blockSize], nil
+}
+
+// load reads the blocks idx to idx+cnt-1 from src unless they have been
+// read already.
+func (fl *Floppy) load(idx, cnt int32) error {
+	for i := idx; i < idx+cnt; i++ {
+		if fl.loaded[i] {
+			continue
+		}
+		ofs := int64(i) * blockSize
+		if _, err := fl.src.ReadAt(fl.img[ofs:ofs+blockSize], ofs); err != nil && err != io.EOF {
+			return fmt.Errorf("cannot read block %d: %w", i, err)
+		}
+		fl.loaded[i] = true
+	}
+	return nil
+}
+
+func (fl *Floppy) getBlock(idx int32) ([]byte, error) {
+	return fl.getBlocks(idx, 1)
+}
+
+// getCluster returns the data of FAT block i.
+func (fl *Floppy) getCluster(i int32) ([]byte, error) {
+	if i < 2 {
+		// FAT blocks 0 and 1 are reserved, clusterStart would return
+		// blocks of the directory for them.
+		return nil, fmt.Errorf("FAT block %d is not a data block", i)
+	}
+	return fl.getBlocks(fl.geo.clusterStart(i), fl.geo.blocksPerCluster)
+}
+
+// nextInChain returns the block following block i in a file's chain, or an
+// error if the chain ends there or is broken.
+func (fl *Floppy) nextInChain(i int32) (int32, error) {
+	if i < 0 || int(i) >= len(fl.fat) {
+		return 0, fmt.Errorf("FAT entry %d out of range", i)
+	}
+	next := fl.fat[i]
+	switch {
+	case next < 0:
+		return 0, fmt.Errorf("FAT chain ends at block %d before the end of the file", i)
+	case next == 0:
+		return 0, fmt.Errorf("block %d links to a free block", i)
+	}
+	return next, nil
+}
+
+// FATBlockSize returns the number of bytes in a FAT block.
+func (fl *Floppy) FATBlockSize() int {
+	return int(fl.geo.blocksPerCluster) * blockSize
+}
+
+// MaxFiles returns the number of files the directory can hold. On Oberon
+// floppies, the first entry of the directory is the volume label. On
+// MS-DOS floppies, the label and subdirectories occupy entries, too, so
+// fewer files fit.
+func (fl *Floppy) MaxFiles() int {
+	n := int(fl.geo.dirEnd-fl.geo.dirStart) * dirEntriesPerBlock
+	if fl.IsDOS() {
+		return n
+	}
+	return n - labelEntries
+}
+
+func (fl *Floppy) readDirBlock(block int32) ([]FileDesc, error) {
+	buf, err := fl.getBlock(block)
+	if err != nil {
+		return nil, err
+	}
+	var res []FileDesc
+	for i := 0; i < dirEntriesPerBlock; i++ {
+		res = append(res, fileDescFromBytes(buf, i))
+	}
+	return res, nil
+}
+
+// fatEntry converts a 12 bit FAT entry. Values from 0xff0 on are reserved,
+// 0xff7 marks a bad block and 0xff8-0xfff the end of a chain, they become
+// negative.
+func fatEntry(n int32) int32 {
+	if n >= 0xff0 {
+		n -= 4096
+	}
+	return n
+}
+
+func (fl *Floppy) initFAT() error {
+	buf, err := fl.getBlocks(fl.geo.fatStart, fl.geo.fatBlocks)
+	if err != nil {
+		return err
+	}
+	// Two 12 bit entries are packed into 3 bytes, little endian: the lower
+	// 12 bits of the 24 bit value are the first entry, the upper 12 bits
+	// the second one. Entries are block numbers, but values from 0xff0 on
+	// have special meanings; fatEntry turns them into negative numbers, so
+	// that they can't be mistaken for blocks.
+	fl.fat = make([]int32, 2*(len(buf)/3))
+	fl.fat[0] = -1
+	fl.fat[1] = -1
+
+	i := 2
+	j := 3
+	for i < len(fl.fat) {
+		n := int32(buf[j+2])<<16 | int32(buf[j+1])<<8 | int32(buf[j])
+		n0 := fatEntry(n % 4096)
+		n1 := fatEntry(n / 4096)
+		fl.fat[i] = n0
+		fl.fat[i+1] = n1
+		i += 2
+		j += 3
+	}
+	return nil
+}
+
+// storeFAT packs the FAT back into the image; it is the inverse of initFAT.
+// All copies of the FAT are written, so that they stay identical. Copies
+// that would overwrite the directory, which happens if its location was
+// overridden with SetDirLocation, are skipped.
+func (fl *Floppy) storeFAT() error {
+	buf, err := fl.getBlocks(fl.geo.fatStart, fl.geo.fatBlocks)
+	if err != nil {
+		return err
+	}
+	i := 2
+	j := 3
+	for i < len(fl.fat) {
+		n := fl.fat[i]&0xfff | (fl.fat[i+1]&0xfff)<<12
+		buf[j] = byte(n)
+		buf[j+1] = byte(n >> 8)
+		buf[j+2] = byte(n >> 16)
+		i += 2
+		j += 3
+	}
+	for c := int32(1); c < fl.geo.fatCopies; c++ {
+		start := fl.geo.fatStart + c*fl.geo.fatBlocks
+		if start+fl.geo.fatBlocks > fl.geo.dirStart {
+			break
+		}
+		dst, err := fl.getBlocks(start, fl.geo.fatBlocks)
+		if err != nil {
+			return err
+		}
+		copy(dst, buf)
+	}
+	return nil
+}
+
+// fatSize returns the number of FAT entries whose data is actually
+// contained in the image.
+func (fl *Floppy) fatSize() int {
+	n := 2 + int((fl.BlockCount()-fl.geo.dataStart)/fl.geo.blocksPerCluster)
+	if n < 0 {
+		return 0
+	}
+	return min(n, len(fl.fat))
+}
+
+// FAT returns a copy of the FAT entries whose blocks are in the image. 0
+// marks a free block, and negative values are the 12 bit values from
+// 0xff0 on: -9 (0xff7) marks a bad block, -8 to -1 (0xff8-0xfff) the end
+// of a chain, and the others are reserved. Entries 0 and 1 are reserved,
+// too.
+func (fl *Floppy) FAT() []int32 {
+	return slices.Clone(fl.fat[:fl.fatSize()])
+}
+
+// MediaDescriptor returns the media descriptor byte from the boot sector.
+func (fl *Floppy) MediaDescriptor() byte {
+	return fl.img[21]
+}
+
+// checkMediaDescriptor reports whether the media descriptor is one that
+// Oberon or MS-DOS use for floppies.
+func (fl *Floppy) checkMediaDescriptor() error {
+	if md := fl.MediaDescriptor(); md != 0xf9 && md != 0xe9 {
+		return fmt.Errorf("%w (media descriptor 0x%02x)", ErrNotOberon, md)
+	}
+	return nil
+}
+
+// IgnoreMediaDescriptor makes the floppy accept any media descriptor, for
+// floppies formatted by unusual tools. It returns the error the check of
+// the media descriptor would have reported, or nil if it is valid.
+func (fl *Floppy) IgnoreMediaDescriptor() error {
+	err := fl.checkMediaDescriptor()
+	fl.anyMedia = true
+	return err
+}
+
+// OEMName returns the name of the system that formatted the floppy, as
+// stored in the boot sector. It is blank if the boot sector doesn't contain
+// a name.
+func (fl *Floppy) OEMName() string {
+	name := fl.img[3:11]
+	for _, c := range name {
+		if c < 0x20 || c > 0x7e {
+			return ""
+		}
+	}
+	return strings.TrimSpace(string(name))
+}
+
+// SerialNumber returns the volume serial number from the extended BIOS
+// parameter block. ok is false if the boot sector doesn't have one, which
+// is the case for Oberon floppies and for floppies formatted by old
+// versions of MS-DOS.
+func (fl *Floppy) SerialNumber() (serial uint32, ok bool) {
+	boot := fl.img
+	if boot[38] != 0x29 {
+		return 0, false
+	}
+	return uint32(boot[42])<<24 | uint32(boot[41])<<16 | uint32(boot[40])<<8 | uint32(boot[39]), true
+}
+
+// VolumeLabel returns the label stored in the first entry of the directory.
+func (fl *Floppy) VolumeLabel() (string, error) {
+	if fl.IsDOS() {
+		return fl.dosVolumeLabel()
+	}
+	dbuf, err := fl.readDirBlock(fl.geo.dirStart)
+	if err != nil {
+		return "", err
+	}
+	fd := dbuf[0]
+	if err := fl.checkVolumeLabel(fd); err != nil {
+		if fl.ignoreLabel {
+			return "", nil
+		}
+		return "", err
+	}
+	// The first byte is the Oberon marker (0 or >= 0xe5), the label follows.
+	return string(bytes.TrimRight(fd.name[1:11], " \x00")), nil
+}
+
+// checkVolumeLabel reports whether fd, the first entry of the directory,
+// is an Oberon volume label. The bytes it checks are logged first, as they
+// are what to look at when a directory can't be read.
+func (fl *Floppy) checkVolumeLabel(fd FileDesc) error {
+	logger.Printf("block %d: label byte: 0x%02x, first name byte: 0x%02x", fl.geo.dirStart, fd.name[11], fd.name[0])
+	if fd.name[11] != 8 {
+		return fmt.Errorf("block %d: %w", fl.geo.dirStart, ErrBadVolumeLabel)
+	}
+	if fd.name[0] < 0xe5 && fd.name[0] != 0 {
+		return fmt.Errorf("block %d: %w (no Oberon marker in the volume label)", fl.geo.dirStart, ErrNotOberon)
+	}
+	return nil
+}
+
+// IgnoreVolumeLabel makes the floppy scan the directory even if its first
+// entry is not a valid volume label, which is often the first thing to be
+// damaged. VolumeLabel then returns an empty label. It returns the error
+// the label check would have reported, or nil if the label is valid.
+func (fl *Floppy) IgnoreVolumeLabel() error {
+	_, err := fl.VolumeLabel()
+	fl.ignoreLabel = true
+	if !errors.Is(err, ErrBadVolumeLabel) && !errors.Is(err, ErrNotOberon) {
+		return nil
+	}
+	return err
+}
+
+// FreeBlocks returns the number of unused blocks in the FAT.
+func (fl *Floppy) FreeBlocks() int {
+	free := 0
+	for i := 2; i < fl.fatSize(); i++ {
+		if fl.fat[i] == 0 {
+			free++
+		}
+	}
+	return free
+}
+
+// UsedBlocks returns the number of blocks in the FAT that are allocated to
+// files.
+func (fl *Floppy) UsedBlocks() int {
+	return fl.fatSize() - 2 - fl.FreeBlocks()
+}
+
+// FreeDirEntries returns the number of files that can still be added to
+// the directory. On MS-DOS floppies, these are the unused and the deleted
+// entries, wherever they are in the directory.
+func (fl *Floppy) FreeDirEntries() (int, error) {
+	if fl.IsDOS() {
+		return fl.dosFreeDirEntries()
+	}
+	n := 0
+	err := fl.ForEachFile(func(FileDesc) error {
+		n++
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return max(fl.MaxFiles()-n, 0), nil
+}
+
+// ListFiles returns the files stored in the floppy's directory. The
+// volume label is not a file, it is returned by VolumeLabel.
+func (fl *Floppy) ListFiles() ([]FileDesc, error) {
+	var res []FileDesc
+	err := fl.ForEachFile(func(fd FileDesc) error {
+		res = append(res, fd)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// ForEachFile calls fn for every file stored in the floppy's directory, in
+// the same order as ListFiles. It stops at the first error returned by fn
+// and returns it.
+func (fl *Floppy) ForEachFile(fn func(FileDesc) error) error {
+	logger.Printf("media descriptor: 0x%02x", fl.MediaDescriptor())
+	if err := fl.checkMediaDescriptor(); err != nil {
+		if !fl.anyMedia {
+			return err
+		}
+		logger.Printf("ignoring %v", err)
+	}
+	if fl.IsDOS() {
+		logger.Printf("MS-DOS formatted")
+		return fl.forEachDOSFile(fn)
+	}
+
+	// Read volume label
+	dbuf, err := fl.readDirBlock(fl.geo.dirStart)
+	if err != nil {
+		return err
+	}
+	if err := fl.checkVolumeLabel(dbuf[0]); err != nil {
+		if !fl.ignoreLabel {
+			return err
+		}
+		logger.Printf("ignoring %v", err)
+	}
+
+	// read directory. It ends with the first unused entry, or at the end of
+	// the directory blocks. dirSlot skips the volume label, so the label is
+	// never passed to fn.
+	cur := fl.geo.dirStart // block in dbuf
+	for k, n := 0, fl.MaxFiles(); k < n; k++ {
+		s, j := fl.dirSlot(k)
+		if s != cur {
+			// The first entry of the next block is checked like any
+			// other, so a block starting with an unused entry ends the
+			// directory, and the blocks after it are never read.
+			dbuf, err = fl.readDirBlock(s)
+			if err != nil {
+				return err
+			}
+			cur = s
+		}
+		if dbuf[j].name[0] == 0 || dbuf[j].name[0] == 0xe5 {
+			break
+		}
+		if err := fn(dbuf[j]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListDeletedFiles returns the deleted files whose directory entries have
+// not been reused yet.
+func (fl *Floppy) ListDeletedFiles() ([]FileDesc, error) {
+	// Make sure the directory is readable at all
+	if _, err := fl.ListFiles(); err != nil {
+		return nil, err
+	}
+	dos := fl.IsDOS()
+	var res []FileDesc
+	for s := fl.geo.dirStart; s < fl.geo.dirEnd; s++ {
+		buf, err := fl.getBlock(s)
+		if err != nil {
+			return nil, err
+		}
+		for j := 0; j < dirEntriesPerBlock; j++ {
+			if !dos && int(s-fl.geo.dirStart)*dirEntriesPerBlock+j < labelEntries {
+				// volume label
+				continue
+			}
+			base := j * fileDescSize
+			if buf[base] == 0 {
+				// never used
+				return res, nil
+			}
+			if buf[base] != 0xe5 {
+				continue
+			}
+			var fd FileDesc
+			if dos {
+				attr := buf[base+11]
+				if attr == dosAttrLongName || attr&(dosAttrVolumeLabel|dosAttrDirectory) != 0 {
+					continue
+				}
+				fd = dosFileDescFromBytes(buf, j)
+			} else {
+				fd = fileDescFromBytes(buf, j)
+			}
+			fd.deleted = true
+			res = append(res, fd)
+		}
+	}
+	return res, nil
+}
+
+// Recoverable reports whether the blocks of a deleted file are still
+// unused. The links in the FAT are cleared when a file is deleted, so the
+// file is assumed to have occupied consecutive blocks.
+func (fl *Floppy) Recoverable(fd FileDesc) bool {
+	if fd.size < 0 {
+		return false
+	}
+	clusterSize := fl.FATBlockSize()
+	n := max(1, (int(fd.size)+clusterSize-1)/clusterSize)
+	for i := int(fd.head); i < int(fd.head)+n; i++ {
+		if i < 2 || i >= fl.fatSize() || fl.fat[i] != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// RecoverFile returns the contents of a deleted file, as far as they can be
+// recovered. If the file's chain in the FAT is still intact, it is
+// followed. Otherwise, the file is assumed to have occupied consecutive
+// blocks. The blocks might have been reused by other files since the file
+// was deleted, so the data can be garbage.
+func (fl *Floppy) RecoverFile(fd FileDesc) ([]byte, error) {
+	if fd.size < 0 {
+		return nil, fmt.Errorf("invalid file size %d", fd.size)
+	}
+	clusterSize := fl.FATBlockSize()
+	n := max(1, (int(fd.size)+clusterSize-1)/clusterSize)
+	chain, err := fl.Chain(fd)
+	if err != nil || len(chain) != n {
+		chain = nil
+		for i := int32(0); i < int32(n); i++ {
+			chain = append(chain, int32(fd.head)+i)
+		}
+	}
+	var res []byte
+	for _, b := range chain {
+		buf, err := fl.getCluster(b)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, buf...)
+	}
+	return res[:fd.size], nil
+}
+
+// ReadFile returns the contents of the file described by fd. If the
+// file's FAT chain breaks before the end of the file, the data read so far
+// is returned together with an error wrapping ErrTruncated.
+func (fl *Floppy) ReadFile(fd FileDesc) ([]byte, error) {
+	return fl.readFile(fd, false)
+}
+
+// ReadFileRaw is like ReadFile, but returns the complete last block of the
+// file, including the slack after the end of the file.
+func (fl *Floppy) ReadFileRaw(fd FileDesc) ([]byte, error) {
+	return fl.readFile(fd, true)
+}
+
+func (fl *Floppy) readFile(fd FileDesc, raw bool) ([]byte, error) {
+	var res []byte
+
+	if fd.size < 0 {
+		// A corrupt entry; the loop below would never run
+		return nil, fmt.Errorf("invalid file size %d", fd.size)
+	}
+	remaining := fd.size
+	if remaining == 0 {
+		return res, nil
+	}
+
+	// A corrupted FAT could link back into the chain, so remember the
+	// blocks we've seen instead of following the links blindly.
+	visited := make(map[int32]bool)
+	i := int32(fd.head)
+	visited[i] = true
+	logger.Printf("%s: reading block %d, %d bytes remaining", fd.Name(), i, remaining)
+	buf, err := fl.getCluster(i)
+	if err != nil {
+		return nil, err
+	}
+	// buf always holds the block that contains the next remaining bytes, so
+	// when the loop ends, it holds the last 1 to clusterSize bytes of the
+	// file. This is also true if the size is a multiple of clusterSize.
+	clusterSize := int32(fl.FATBlockSize())
+	for remaining > clusterSize {
+		res = append(res, buf...)
+		remaining -= clusterSize
+		i, err = fl.nextInChain(i)
+		if err != nil {
+			return res, truncated(len(res), fd.size, err)
+		}
+		if visited[i] {
+			return res, truncated(len(res), fd.size, fmt.Errorf("FAT cycle detected starting at block %d", i))
+		}
+		visited[i] = true
+		logger.Printf("%s: reading block %d, %d bytes remaining", fd.Name(), i, remaining)
+		buf, err = fl.getCluster(i)
+		if err != nil {
+			return res, truncated(len(res), fd.size, err)
+		}
+	}
+	if raw {
+		remaining = clusterSize
+	}
+	res = append(res, buf[0:remaining]...)
+
+	return res, nil
+}
+
+// truncated returns the error for a file of size bytes, of which only
+// read bytes could be read because of err.
+func truncated(read int, size int32, err error) error {
+	return fmt.Errorf("%w at %d of %d bytes: %w", ErrTruncated, read, size, err)
+}
+
+// Chain returns the FAT blocks occupied by the file, in order. The chain
+// is followed until a block is marked as the end of the chain (a negative
+// FAT entry). If the chain is broken, the blocks found so far are returned
+// together with the error.
+func (fl *Floppy) Chain(fd FileDesc) ([]int32, error) {
+	var res []int32
+	visited := make(map[int32]bool)
+	i := int32(fd.head)
+	for {
+		if i < 2 || int(i) >= fl.fatSize() {
+			return res, fmt.Errorf("block %d out of range", i)
+		}
+		if visited[i] {
+			return res, fmt.Errorf("FAT cycle detected starting at block %d", i)
+		}
+		visited[i] = true
+		res = append(res, i)
+		next := fl.fat[i]
+		if next < 0 {
+			return res, nil
+		}
+		if next == 0 {
+			return res, fmt.Errorf("block %d links to a free block", i)
+		}
+		i = next
+	}
+}
+
+// allocBlocks finds n free blocks in the FAT, in the order they should be
+// chained. To keep files unfragmented, the first run of n consecutive free
+// blocks is preferred. Only if there is none, the first n free blocks are
+// used. The blocks are not marked as used.
+func (fl *Floppy) allocBlocks(n int) ([]int32, error) {
+	run := 0
+	for i := 2; i < fl.fatSize(); i++ {
+		if fl.fat[i] != 0 {
+			run = 0
+			continue
+		}
+		run++
+		if run == n {
+			res := make([]int32, n)
+			for k := range res {
+				res[k] = int32(i - n + 1 + k)
+			}
+			return res, nil
+		}
+	}
+
+	var res []int32
+	for i := 2; i < fl.fatSize() && len(res) < n; i++ {
+		if fl.fat[i] == 0 {
+			res = append(res, int32(i))
+		}
+	}
+	if len(res) < n {
+		return nil, ErrNoSpace
+	}
+	return res, nil
+}
+
+// dirSlot returns the block and the index within the block of the k-th
+// file's directory entry.
+func (fl *Floppy) dirSlot(k int) (int32, int) {
+	pos := k + labelEntries
+	return fl.geo.dirStart + int32(pos/dirEntriesPerBlock), pos % dirEntriesPerBlock
+}
+
+func (fl *Floppy) writeDirEntry(k int, fd FileDesc) error {
+	s, j := fl.dirSlot(k)
+	buf, err := fl.getBlock(s)
+	if err != nil {
+		return err
+	}
+	fd.toBytes(buf, j)
+	return nil
+}
+
+// checkName checks that name can be stored in a directory entry.
+func checkName(name string) error {
+	if len(name) == 0 || len(name) > maxFilenameLen {
+		return fmt.Errorf("filename %q must have 1 to %d characters", name, maxFilenameLen)
+	}
+	if strings.IndexByte(name, 0) >= 0 || name[0] == 0xe5 {
+		return fmt.Errorf("invalid filename %q", name)
+	}
+	return nil
+}
+
+// AddFile stores data as a new file called name, with modification time
+// mtime. The changes are only made in memory, use Save to write them back.
+func (fl *Floppy) AddFile(name string, data []byte, mtime time.Time) error {
+	if fl.IsDOS() {
+		return errMSDOSReadOnly
+	}
+	if err := checkName(name); err != nil {
+		return err
+	}
+	fds, err := fl.ListFiles()
+	if err != nil {
+		return err
+	}
+	for _, fd := range fds {
+		if fd.Name() == name {
+			return fmt.Errorf("%w: %q", ErrFileExists, name)
+		}
+	}
+
+	var fd FileDesc
+	copy(fd.name[:], name)
+	fd.size = int32(len(data))
+	if err := fd.setTimestamp(mtime); err != nil {
+		return err
+	}
+	if len(fds) >= fl.MaxFiles() {
+		return ErrDirectoryFull
+	}
+	// Even empty files occupy a block
+	clusterSize := fl.FATBlockSize()
+	chain, err := fl.allocBlocks(max(1, (len(data)+clusterSize-1)/clusterSize))
+	if err != nil {
+		return err
+	}
+	fd.head = int16(chain[0])
+
+	for k, b := range chain {
+		buf, err := fl.getCluster(b)
+		if err != nil {
+			return err
+		}
+		n := copy(buf, data[min(k*clusterSize, len(data)):])
+		clear(buf[n:])
+		if k+1 < len(chain) {
+			fl.fat[b] = chain[k+1]
+		} else {
+			fl.fat[b] = -1
+		}
+	}
+	if err := fl.storeFAT(); err != nil {
+		return err
+	}
+	return fl.writeDirEntry(len(fds), fd)
+}
+
+// RenameFile renames the file called oldName to newName. The changes are
+// only made in memory, use Save to write them back.
+func (fl *Floppy) RenameFile(oldName, newName string) error {
+	if fl.IsDOS() {
+		return errMSDOSReadOnly
+	}
+	if err := checkName(newName); err != nil {
+		return err
+	}
+	fds, err := fl.ListFiles()
+	if err != nil {
+		return err
+	}
+	if slices.ContainsFunc(fds, func(fd FileDesc) bool { return fd.Name() == newName }) {
+		return fmt.Errorf("%w: %q", ErrFileExists, newName)
+	}
+	k := slices.IndexFunc(fds, func(fd FileDesc) bool { return fd.Name() == oldName })
+	if k < 0 {
+		return fmt.Errorf("%w: %q", ErrFileNotFound, oldName)
+	}
+	fd := fds[k]
+	fd.name = [maxFilenameLen]byte{}
+	copy(fd.name[:], newName)
+	return fl.writeDirEntry(k, fd)
+}
+
+// SetFileTimestamp sets the modification time of the file called name to
+// t. If t is the zero time, the date and time fields are cleared. The
+// changes are only made in memory, use Save to write them back.
+func (fl *Floppy) SetFileTimestamp(name string, t time.Time) error {
+	if fl.IsDOS() {
+		return errMSDOSReadOnly
+	}
+	fds, err := fl.ListFiles()
+	if err != nil {
+		return err
+	}
+	k := slices.IndexFunc(fds, func(fd FileDesc) bool { return fd.Name() == name })
+	if k < 0 {
+		return fmt.Errorf("%w: %q", ErrFileNotFound, name)
+	}
+	fd := fds[k]
+	if t.IsZero() {
+		fd.date, fd.time = 0, 0
+	} else if err := fd.setTimestamp(t); err != nil {
+		return err
+	}
+	return fl.writeDirEntry(k, fd)
+}
+
+// RemoveFile deletes the file called name and frees its blocks. The
+// changes are only made in memory, use Save to write them back.
+func (fl *Floppy) RemoveFile(name string) error {
+	if fl.IsDOS() {
+		return errMSDOSReadOnly
+	}
+	fds, err := fl.ListFiles()
+	if err != nil {
+		return err
+	}
+	k := slices.IndexFunc(fds, func(fd FileDesc) bool { return fd.Name() == name })
+	if k < 0 {
+		return fmt.Errorf("%w: %q", ErrFileNotFound, name)
+	}
+	fd := fds[k]
+	chain, err := fl.Chain(fd)
+	if err != nil {
+		return fmt.Errorf("can't free the blocks of %q: %w", name, err)
+	}
+	for _, b := range chain {
+		fl.fat[b] = 0
+	}
+	if err := fl.storeFAT(); err != nil {
+		return err
+	}
+
+	// ListFiles stops at the first unused entry, so the directory must not
+	// have holes: move the following entries up, and put the deleted entry
+	// at the end.
+	for m := k; m < len(fds)-1; m++ {
+		if err := fl.writeDirEntry(m, fds[m+1]); err != nil {
+			return err
+		}
+	}
+	fd.name[0] = 0xe5
+	return fl.writeDirEntry(len(fds)-1, fd)
+}
+
+// WriteTo writes the complete image to w, including the changes made in
+// memory. Compressed images are written uncompressed.
+func (fl *Floppy) WriteTo(w io.Writer) (int64, error) {
+	if fl.src != nil {
+		if err := fl.load(0, fl.BlockCount()); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.Write(fl.img)
+	return int64(n), err
+}
+
+// Save writes the image to filename. Compressed images can't be saved.
+func (fl *Floppy) Save(filename string) error {
+	if fl.compressed {
+		return errCompressedReadOnly
+	}
+	if fl.device {
+		return errDeviceReadOnly
+	}
+	if fl.src != nil {
+		if err := fl.load(0, fl.BlockCount()); err != nil {
+			return err
+		}
+	}
+	img := fl.img
+	if fl.unmap != nil {
+		// The unmodified parts of a mapped image are read from the file,
+		// which os.WriteFile truncates before writing.
+		img = bytes.Clone(img)
+	}
+	return os.WriteFile(filename, img, 0666)
+}
+
+// Open reads the floppy image stored in filename. If filename is "-", the
+// image is read from stdin. Images compressed with gzip are decompressed.
+// filename can also be a device such as /dev/sdb, to read the floppy in a
+// drive directly; it can't be modified then.
+func Open(filename string) (*Floppy, error) {
+	var img []byte
+	var device bool
+	var err error
+	if filename == "-" {
+		img, err = io.ReadAll(os.Stdin)
+	} else {
+		img, device, err = readImage(filename)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot open image: %w", err)
+	}
+	compressed := bytes.HasPrefix(img, gzipMagic)
+	if compressed {
+		zr, err := gzip.NewReader(bytes.NewReader(img))
+		if err != nil {
+			return nil, fmt.Errorf("cannot open image: %w", err)
+		}
+		img, err = io.ReadAll(zr)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decompress image: %w", err)
+		}
+	}
+	fl, err := OpenBytes(img)
+	if err != nil {
+		return nil, err
+	}
+	fl.compressed = compressed
+	fl.device = device
+	return fl, nil
+}
+
+// gzipMagic are the first bytes of gzip compressed files.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// OpenMapped is like Open, but maps the image into memory instead of
+// reading it, so only the blocks that are accessed are read from disk.
+// Changes to the floppy are not written to filename unless Save is called.
+// Call Close to release the mapping.
+func OpenMapped(filename string) (*Floppy, error) {
+	if filename == "-" {
+		return Open(filename)
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open image: %w", err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("cannot open image: %w", err)
+	}
+	if fi.Mode()&os.ModeDevice != 0 {
+		// The size of devices is unknown to Stat
+		return Open(filename)
+	}
+	if fi.Size() < blockSize {
+		return nil, errImageTooSmall
+	}
+	img, unmap, err := mapFile(f, int(fi.Size()))
+	if err != nil {
+		return nil, fmt.Errorf("cannot open image: %w", err)
+	}
+	if bytes.HasPrefix(img, gzipMagic) {
+		// Compressed images need to be decompressed completely anyway
+		unmap()
+		return Open(filename)
+	}
+	fl, err := OpenBytes(img)
+	if err != nil {
+		unmap()
+		return nil, err
+	}
+	fl.unmap = unmap
+	return fl, nil
+}
+
+// Close releases the resources held by the floppy. It must not be used
+// afterwards.
+func (fl *Floppy) Close() error {
+	if fl.unmap == nil {
+		return nil
+	}
+	err := fl.unmap()
+	fl.img, fl.unmap = nil, nil
+	return err
+}
+
+// OpenBytes returns the floppy whose image is img. The image is not copied,
+// so changes to the floppy modify img.
+func OpenBytes(img []byte) (*Floppy, error) {
+	if len(img) < blockSize {
+		return nil, errImageTooSmall
+	}
+	fl := &Floppy{img: img}
+	if err := fl.init(); err != nil {
+		return nil, err
+	}
+	return fl, nil
+}
+
+// OpenReaderAt returns the floppy whose image of size bytes is read from
+// r. Blocks are only read when they are accessed, which helps with images
+// that are not stored in files, e.g. in archives or on the network.
+func OpenReaderAt(r io.ReaderAt, size int64) (*Floppy, error) {
+	if size < blockSize {
+		return nil, errImageTooSmall
+	}
+	fl := &Floppy{
+		img:    make([]byte, size/blockSize*blockSize),
+		src:    r,
+		loaded: make([]bool, size/blockSize),
+	}
+	if err := fl.load(0, 1); err != nil {
+		return nil, fmt.Errorf("cannot open image: %w", err)
+	}
+	if err := fl.init(); err != nil {
+		return nil, err
+	}
+	return fl, nil
+}
+
+// init detects the layout of the image and reads its FAT.
+func (fl *Floppy) init() error {
+	fl.geo = detectGeometry(fl.img[:blockSize])
+	if fl.BlockCount() < fl.geo.fatStart+fl.geo.fatBlocks {
+		return errImageTooSmall
+	}
+	return fl.initFAT()
+}
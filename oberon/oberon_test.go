@@ -0,0 +1,1003 @@
+/*
+ * Copyright (c) 2023 Andreas Signer <asigner@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by the
+ * Free Software Foundation, either version 3 of the License, or (at your
+ * option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+ * for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package oberon
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// Make the timestamps independent of the machine running the tests
+	SetLocation(time.UTC)
+	os.Exit(m.Run())
+}
+
+// testImage builds a 720K Oberon floppy image in memory. Files are stored
+// in the directory in the order they are added, and their data is stored
+// in consecutive clusters unless a chain is given.
+type testImage struct {
+	img   []byte
+	files int   // number of files in the directory
+	next  int32 // next unused cluster
+}
+
+const testClusterSize = blocksPerCluster * blockSize
+
+func newTestImage() *testImage {
+	ti := &testImage{img: make([]byte, 1440*blockSize), next: 2}
+	ti.img[21] = 0xf9 // media descriptor
+	ti.setFAT(0, 0xff9)
+	ti.setFAT(1, 0xfff)
+	label := ti.entry(-1)
+	copy(label[1:11], "TESTDISK  ")
+	label[11] = 8
+	return ti
+}
+
+// setFAT sets FAT entry i to the 12 bit value v. Two entries are packed
+// into 3 bytes.
+func (ti *testImage) setFAT(i int32, v int32) {
+	fat := ti.img[fatStartBlock*blockSize:]
+	ofs := i / 2 * 3
+	v &= 0xfff
+	if i%2 == 0 {
+		fat[ofs] = byte(v)
+		fat[ofs+1] = fat[ofs+1]&0xf0 | byte(v>>8)
+	} else {
+		fat[ofs+1] = fat[ofs+1]&0x0f | byte(v<<4)
+		fat[ofs+2] = byte(v >> 4)
+	}
+}
+
+// entry returns the directory entry of the k-th file; -1 is the volume
+// label.
+func (ti *testImage) entry(k int) []byte {
+	ofs := dirStartBlock*blockSize + (k+labelEntries)*fileDescSize
+	return ti.img[ofs : ofs+fileDescSize]
+}
+
+// cluster returns the data of FAT block c.
+func (ti *testImage) cluster(c int32) []byte {
+	ofs := defaultGeometry.clusterStart(c) * blockSize
+	return ti.img[ofs : ofs+testClusterSize]
+}
+
+// addFile stores a file in the next unused clusters and returns its chain.
+// Like AddFile, empty files get a cluster, too.
+func (ti *testImage) addFile(name string, data []byte, ts time.Time) []int32 {
+	chain := make([]int32, max(1, (len(data)+testClusterSize-1)/testClusterSize))
+	for k := range chain {
+		chain[k] = ti.next
+		ti.next++
+	}
+	ti.addFileAt(name, data, ts, chain)
+	return chain
+}
+
+// addFileAt stores a file in the clusters of chain, in that order.
+func (ti *testImage) addFileAt(name string, data []byte, ts time.Time, chain []int32) {
+	for k, c := range chain {
+		copy(ti.cluster(c), data[min(k*testClusterSize, len(data)):])
+		next := int32(0xfff)
+		if k+1 < len(chain) {
+			next = chain[k+1]
+		}
+		ti.setFAT(c, next)
+	}
+	e := ti.entry(ti.files)
+	ti.files++
+	copy(e[:maxFilenameLen], name)
+	date, tm := packTimestamp(ts)
+	binary.LittleEndian.PutUint16(e[22:], tm)
+	binary.LittleEndian.PutUint16(e[24:], date)
+	binary.LittleEndian.PutUint16(e[26:], uint16(chain[0]))
+	binary.LittleEndian.PutUint32(e[28:], uint32(len(data)))
+}
+
+// setSize overwrites the size stored in the directory entry of the k-th
+// file.
+func (ti *testImage) setSize(k int, size int32) {
+	binary.LittleEndian.PutUint32(ti.entry(k)[28:], uint32(size))
+}
+
+func (ti *testImage) open(t *testing.T) *Floppy {
+	t.Helper()
+	fl, err := OpenBytes(ti.img)
+	if err != nil {
+		t.Fatalf("OpenBytes: %v", err)
+	}
+	return fl
+}
+
+// packTimestamp encodes t in the date and time format of Oberon floppies.
+func packTimestamp(t time.Time) (date, tm uint16) {
+	date = uint16((t.Year()-1900)<<9 | int(t.Month())<<5 | t.Day())
+	tm = uint16(t.Hour()<<11 | t.Minute()<<5 | t.Second()/2)
+	return date, tm
+}
+
+// testData returns n bytes of data that differ from cluster to cluster,
+// so that reading a wrong cluster is noticed.
+func testData(n int, seed byte) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = seed + byte(i/testClusterSize)*17 + byte(i%251)
+	}
+	return data
+}
+
+var testTime = time.Date(1990, 5, 17, 14, 23, 42, 0, time.UTC)
+
+func TestListFiles(t *testing.T) {
+	ti := newTestImage()
+	ti.addFile("Kernel.Mod", testData(3000, 1), testTime)
+	ti.addFile("Oberon.Text", testData(100, 2), testTime)
+	ti.addFile("Empty.Bak", nil, testTime)
+	fl := ti.open(t)
+
+	label, err := fl.VolumeLabel()
+	if err != nil || label != "TESTDISK" {
+		t.Errorf("VolumeLabel() = %q, %v, want %q", label, err, "TESTDISK")
+	}
+	fds, err := fl.ListFiles()
+	if err != nil {
+		t.Fatalf("ListFiles: %v", err)
+	}
+	want := []struct {
+		name string
+		size int32
+		head int16
+	}{
+		{"Kernel.Mod", 3000, 2},
+		{"Oberon.Text", 100, 5},
+		{"Empty.Bak", 0, 6},
+	}
+	if len(fds) != len(want) {
+		t.Fatalf("ListFiles returned %d files, want %d", len(fds), len(want))
+	}
+	for k, w := range want {
+		fd := fds[k]
+		if fd.Name() != w.name || fd.Size() != w.size || fd.Head() != w.head {
+			t.Errorf("file %d = %q, size %d, head %d, want %q, size %d, head %d",
+				k, fd.Name(), fd.Size(), fd.Head(), w.name, w.size, w.head)
+		}
+	}
+}
+
+func TestReadFile(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+	}{
+		{"Small.Text", 10},
+		{"Two.Obj", 1500},
+		{"Kernel.Mod", 5000},
+	}
+	ti := newTestImage()
+	for k, tt := range tests {
+		ti.addFile(tt.name, testData(tt.size, byte(k)), testTime)
+	}
+	fl := ti.open(t)
+	fds, err := fl.ListFiles()
+	if err != nil {
+		t.Fatalf("ListFiles: %v", err)
+	}
+	for k, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := fl.ReadFile(fds[k])
+			if err != nil {
+				t.Fatalf("ReadFile: %v", err)
+			}
+			if !bytes.Equal(data, testData(tt.size, byte(k))) {
+				t.Errorf("ReadFile returned wrong data")
+			}
+		})
+	}
+}
+
+func TestTimestamp(t *testing.T) {
+	tests := []struct {
+		date, time uint16
+		want       time.Time
+	}{
+		{0xb4b1, 0x72f5, time.Date(1990, 5, 17, 14, 23, 42, 0, time.UTC)},
+		{0x2021, 0x0000, time.Date(1916, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{0xff9f, 0xbf7d, time.Date(2027, 12, 31, 23, 59, 58, 0, time.UTC)},
+		// 31*2 seconds are clamped to 59
+		{0xb4b1, 0x001f, time.Date(1990, 5, 17, 0, 0, 59, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		var fd FileDesc
+		fd.date, fd.time = int16(tt.date), int16(tt.time)
+		if got := fd.Timestamp(); !got.Equal(tt.want) {
+			t.Errorf("Timestamp() of date 0x%04x, time 0x%04x = %v, want %v", tt.date, tt.time, got, tt.want)
+		}
+	}
+}
+
+func TestTimestampRoundTrip(t *testing.T) {
+	tests := []struct {
+		in, want time.Time
+	}{
+		{testTime, testTime},
+		{time.Date(1990, 5, 17, 14, 59, 58, 0, time.UTC), time.Date(1990, 5, 17, 14, 59, 58, 0, time.UTC)},
+		{time.Date(1999, 12, 31, 23, 59, 59, 0, time.UTC), time.Date(1999, 12, 31, 23, 59, 58, 0, time.UTC)},
+		{time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{time.Date(2027, 6, 30, 12, 1, 3, 0, time.UTC), time.Date(2027, 6, 30, 12, 1, 2, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		var fd FileDesc
+		if err := fd.setTimestamp(tt.in); err != nil {
+			t.Errorf("setTimestamp(%v): %v", tt.in, err)
+			continue
+		}
+		if got := fd.Timestamp(); !got.Equal(tt.want) {
+			t.Errorf("Timestamp() after setTimestamp(%v) = %v, want %v", tt.in, got, tt.want)
+		}
+		date, tm := packTimestamp(tt.in)
+		if uint16(fd.date) != date || uint16(fd.time) != tm {
+			t.Errorf("setTimestamp(%v) stored date 0x%04x, time 0x%04x, want 0x%04x, 0x%04x", tt.in, uint16(fd.date), uint16(fd.time), date, tm)
+		}
+	}
+}
+
+func TestReadFileCycle(t *testing.T) {
+	tests := []struct {
+		name      string
+		from, to  int32 // FAT link replaced to create the cycle
+		wantBlock int32
+	}{
+		{"self", 3, 3, 3},
+		{"back to head", 4, 2, 2},
+		{"back to middle", 4, 3, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ti := newTestImage()
+			ti.addFile("Loop.Mod", testData(3000, 0), testTime)
+			ti.setFAT(tt.from, tt.to)
+			// Claim more data than the chain holds, so the cycle is followed
+			ti.setSize(0, 5000)
+			fl := ti.open(t)
+			fds, err := fl.ListFiles()
+			if err != nil {
+				t.Fatalf("ListFiles: %v", err)
+			}
+			want := fmt.Sprintf("FAT cycle detected starting at block %d", tt.wantBlock)
+			if _, err := fl.ReadFile(fds[0]); err == nil || !strings.Contains(err.Error(), want) {
+				t.Errorf("ReadFile error = %v, want %q", err, want)
+			}
+			if _, err := fl.Chain(fds[0]); err == nil || !strings.Contains(err.Error(), want) {
+				t.Errorf("Chain error = %v, want %q", err, want)
+			}
+		})
+	}
+}
+
+func TestAddRemoveFile(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+	}{
+		{"Empty.Bak", 0},
+		{"Small.Text", 100},
+		{"One.Obj", 1024},
+		{"Two.Obj", 1025},
+		{"Kernel.Mod", 5000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ti := newTestImage()
+			ti.addFile("First.Mod", testData(2000, 1), testTime)
+			ti.addFile("Last.Mod", testData(300, 2), testTime)
+			fl := ti.open(t)
+			free := fl.FreeBlocks()
+
+			if err := fl.AddFile(tt.name, testData(tt.size, 3), testTime); err != nil {
+				t.Fatalf("AddFile: %v", err)
+			}
+			if got, want := fl.FreeBlocks(), free-max(1, (tt.size+testClusterSize-1)/testClusterSize); got != want {
+				t.Errorf("FreeBlocks() after AddFile = %d, want %d", got, want)
+			}
+			// Remove a file before the new one, so the directory is compacted
+			if err := fl.RemoveFile("First.Mod"); err != nil {
+				t.Fatalf("RemoveFile: %v", err)
+			}
+			if err := fl.RemoveFile(tt.name); err != nil {
+				t.Fatalf("RemoveFile: %v", err)
+			}
+			if got := fl.FreeBlocks(); got != free+2 {
+				t.Errorf("FreeBlocks() after RemoveFile = %d, want %d", got, free+2)
+			}
+			fds, err := fl.ListFiles()
+			if err != nil {
+				t.Fatalf("ListFiles: %v", err)
+			}
+			if len(fds) != 1 || fds[0].Name() != "Last.Mod" {
+				t.Fatalf("ListFiles() = %v, want only Last.Mod", fds)
+			}
+			data, err := fl.ReadFile(fds[0])
+			if err != nil || !bytes.Equal(data, testData(300, 2)) {
+				t.Errorf("ReadFile(Last.Mod) = wrong data, %v", err)
+			}
+		})
+	}
+}
+
+func TestReadFileClusterMultiple(t *testing.T) {
+	tests := []struct {
+		name  string
+		size  int
+		chain []int32
+	}{
+		{"One.Obj", 1024, []int32{20}},
+		{"Two.Obj", 2048, []int32{30, 22}},
+		{"Three.Obj", 3072, []int32{40, 24, 35}},
+	}
+	ti := newTestImage()
+	for k, tt := range tests {
+		ti.addFileAt(tt.name, testData(tt.size, byte(k)), testTime, tt.chain)
+	}
+	// Fill the clusters after the chains, so reading one block too many
+	// or taking the last block from the wrong place is noticed
+	for _, c := range []int32{21, 23, 25, 31, 36, 41} {
+		copy(ti.cluster(c), bytes.Repeat([]byte{0xaa}, testClusterSize))
+	}
+	fl := ti.open(t)
+	fds, err := fl.ListFiles()
+	if err != nil {
+		t.Fatalf("ListFiles: %v", err)
+	}
+	for k, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := testData(tt.size, byte(k))
+			data, err := fl.ReadFile(fds[k])
+			if err != nil {
+				t.Fatalf("ReadFile: %v", err)
+			}
+			if !bytes.Equal(data, want) {
+				t.Errorf("ReadFile returned wrong data")
+			}
+			data, err = fl.ReadFileRaw(fds[k])
+			if err != nil || !bytes.Equal(data, want) {
+				t.Errorf("ReadFileRaw returned %d bytes, %v; want the file", len(data), err)
+			}
+			r, err := fl.Open(fds[k])
+			if err != nil {
+				t.Fatalf("Open: %v", err)
+			}
+			defer r.Close()
+			data, err = io.ReadAll(r)
+			if err != nil || !bytes.Equal(data, want) {
+				t.Errorf("reading via Open returned %d bytes, %v; want the file", len(data), err)
+			}
+			chain, err := fl.Chain(fds[k])
+			if err != nil {
+				t.Fatalf("Chain: %v", err)
+			}
+			if fmt.Sprint(chain) != fmt.Sprint(tt.chain) {
+				t.Errorf("Chain() = %v, want %v", chain, tt.chain)
+			}
+		})
+	}
+}
+
+func TestEmptyFile(t *testing.T) {
+	tests := []struct {
+		name       string
+		date, time uint16
+		valid      bool
+	}{
+		{"Valid.Bak", 0xb4b1, 0x72f5, true},
+		{"Zero.Bak", 0, 0, false},
+		{"Garbage.Bak", 0xffff, 0xffff, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ti := newTestImage()
+			ti.addFile(tt.name, nil, testTime)
+			e := ti.entry(0)
+			binary.LittleEndian.PutUint16(e[22:], tt.time)
+			binary.LittleEndian.PutUint16(e[24:], tt.date)
+			ti.addFile("After.Text", testData(10, 1), testTime)
+			fl := ti.open(t)
+
+			// The scan must not stop at the empty file
+			fds, err := fl.ListFiles()
+			if err != nil {
+				t.Fatalf("ListFiles: %v", err)
+			}
+			if len(fds) != 2 || fds[0].Name() != tt.name || fds[1].Name() != "After.Text" {
+				t.Fatalf("ListFiles() = %v, want %s and After.Text", fds, tt.name)
+			}
+			if got := fds[0].ValidTimestamp(); got != tt.valid {
+				t.Errorf("ValidTimestamp() = %v, want %v", got, tt.valid)
+			}
+			data, err := fl.ReadFile(fds[0])
+			if err != nil || len(data) != 0 {
+				t.Errorf("ReadFile() = %d bytes, %v, want 0 bytes", len(data), err)
+			}
+			r, err := fl.Open(fds[0])
+			if err != nil {
+				t.Fatalf("Open: %v", err)
+			}
+			defer r.Close()
+			data, err = io.ReadAll(r)
+			if err != nil || len(data) != 0 {
+				t.Errorf("reading via Open returned %d bytes, %v, want 0 bytes", len(data), err)
+			}
+		})
+	}
+}
+
+func TestRecoverFile(t *testing.T) {
+	tests := []struct {
+		name        string
+		size        int32
+		reuse       bool // allocate the deleted file's second block again
+		recoverable bool
+		wantErr     bool
+	}{
+		{"Intact.Mod", 3000, false, true, false},
+		{"Reused.Mod", 3000, true, false, false},
+		{"Negative.Mod", -1, false, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ti := newTestImage()
+			ti.addFile("Kept.Text", testData(100, 1), testTime)
+			data := testData(3000, 2)
+			chain := ti.addFile(tt.name, data, testTime)
+			ti.setSize(1, tt.size)
+			ti.entry(1)[0] = 0xe5
+			for _, c := range chain {
+				ti.setFAT(c, 0)
+			}
+			if tt.reuse {
+				ti.setFAT(chain[1], 0xfff)
+			}
+			fl := ti.open(t)
+
+			fds, err := fl.ListDeletedFiles()
+			if err != nil {
+				t.Fatalf("ListDeletedFiles: %v", err)
+			}
+			if len(fds) != 1 || fds[0].Name() != "?"+tt.name[1:] {
+				t.Fatalf("ListDeletedFiles() = %v, want %s", fds, tt.name)
+			}
+			if got := fl.Recoverable(fds[0]); got != tt.recoverable {
+				t.Errorf("Recoverable() = %v, want %v", got, tt.recoverable)
+			}
+			got, err := fl.RecoverFile(fds[0])
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("RecoverFile() succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("RecoverFile: %v", err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("RecoverFile returned wrong data")
+			}
+		})
+	}
+}
+
+func TestRenameFile(t *testing.T) {
+	tests := []struct {
+		name             string
+		oldName, newName string
+		wantErr          bool
+		errIs            error    // if set, the error must wrap it
+		want             []string // files listed afterwards
+	}{
+		{"rename", "Oberon.Text", "System.Text", false, nil, []string{"Kernel.Mod", "System.Text"}},
+		{"longest name", "Kernel.Mod", "ABCDEFGHIJKLMNOPQRSTUV", false, nil, []string{"ABCDEFGHIJKLMNOPQRSTUV", "Oberon.Text"}},
+		{"name too long", "Kernel.Mod", "ABCDEFGHIJKLMNOPQRSTUVW", true, nil, []string{"Kernel.Mod", "Oberon.Text"}},
+		{"exists", "Kernel.Mod", "Oberon.Text", true, ErrFileExists, []string{"Kernel.Mod", "Oberon.Text"}},
+		{"not found", "Missing.Mod", "System.Text", true, ErrFileNotFound, []string{"Kernel.Mod", "Oberon.Text"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ti := newTestImage()
+			ti.addFile("Kernel.Mod", testData(3000, 1), testTime)
+			ti.addFile("Oberon.Text", testData(100, 2), testTime)
+			fl := ti.open(t)
+
+			err := fl.RenameFile(tt.oldName, tt.newName)
+			if (err != nil) != tt.wantErr || tt.errIs != nil && !errors.Is(err, tt.errIs) {
+				t.Fatalf("RenameFile() = %v, want error %v", err, tt.wantErr)
+			}
+
+			// Reopen the image to make sure the change was written to it
+			fl = ti.open(t)
+			fds, err := fl.ListFiles()
+			if err != nil {
+				t.Fatalf("ListFiles: %v", err)
+			}
+			var names []string
+			for _, fd := range fds {
+				names = append(names, fd.Name())
+			}
+			if fmt.Sprint(names) != fmt.Sprint(tt.want) {
+				t.Errorf("ListFiles() = %v, want %v", names, tt.want)
+			}
+			// Only the name changes
+			for k, fd := range fds {
+				data, err := fl.ReadFile(fd)
+				if err != nil || !bytes.Equal(data, testData([]int{3000, 100}[k], byte(k+1))) {
+					t.Errorf("ReadFile(%s) = wrong data, %v", fd.Name(), err)
+				}
+			}
+		})
+	}
+}
+
+func TestListFilesAcrossBlocks(t *testing.T) {
+	// Block 7 holds the volume label and 15 files, so the 16th file is
+	// the first entry of block 8.
+	tests := []int{15, 16, 20, 31, 32}
+	for _, n := range tests {
+		t.Run(fmt.Sprint(n), func(t *testing.T) {
+			ti := newTestImage()
+			for k := 0; k < n; k++ {
+				ti.addFile(fmt.Sprintf("File%02d.Text", k), testData(10, byte(k)), testTime)
+			}
+			fl := ti.open(t)
+			fds, err := fl.ListFiles()
+			if err != nil {
+				t.Fatalf("ListFiles: %v", err)
+			}
+			if len(fds) != n {
+				t.Fatalf("ListFiles returned %d files, want %d", len(fds), n)
+			}
+			for k, fd := range fds {
+				if want := fmt.Sprintf("File%02d.Text", k); fd.Name() != want {
+					t.Errorf("file %d = %q, want %q", k, fd.Name(), want)
+				}
+			}
+			free, err := fl.FreeDirEntries()
+			if err != nil || free != fl.MaxFiles()-n {
+				t.Errorf("FreeDirEntries() = %d, %v, want %d", free, err, fl.MaxFiles()-n)
+			}
+		})
+	}
+}
+
+func TestAllocBlocks(t *testing.T) {
+	// Blocks 2, 4-5, 8-10 and 15 are used, which leaves runs of 1, 2 and
+	// 4 free blocks before the free rest of the floppy.
+	used := []int32{2, 4, 5, 8, 9, 10, 15}
+	tests := []struct {
+		name   string
+		blocks int
+		full   bool // also use all blocks from 16 on
+		want   []int32
+	}{
+		{"one", 1, false, []int32{3}},
+		{"two", 2, false, []int32{6, 7}},
+		{"three", 3, false, []int32{11, 12, 13}},
+		{"four", 4, false, []int32{11, 12, 13, 14}},
+		{"five", 5, false, []int32{16, 17, 18, 19, 20}},
+		{"scattered", 5, true, []int32{3, 6, 7, 11, 12}},
+		{"no space", 8, true, []int32{3, 6, 7, 11, 12, 13, 14}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ti := newTestImage()
+			for _, c := range used {
+				ti.setFAT(c, 0xfff)
+			}
+			fl := ti.open(t)
+			if tt.full {
+				for i := 16; i < fl.fatSize(); i++ {
+					fl.fat[i] = -1
+				}
+			}
+			data := testData(tt.blocks*testClusterSize, 1)
+			err := fl.AddFile("Alloc.Bin", data, testTime)
+			if len(tt.want) < tt.blocks {
+				if !errors.Is(err, ErrNoSpace) {
+					t.Fatalf("AddFile() = %v, want %v", err, ErrNoSpace)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("AddFile: %v", err)
+			}
+			fds, err := fl.ListFiles()
+			if err != nil {
+				t.Fatalf("ListFiles: %v", err)
+			}
+			chain, err := fl.Chain(fds[0])
+			if err != nil {
+				t.Fatalf("Chain: %v", err)
+			}
+			if fmt.Sprint(chain) != fmt.Sprint(tt.want) {
+				t.Errorf("Chain() = %v, want %v", chain, tt.want)
+			}
+			got, err := fl.ReadFile(fds[0])
+			if err != nil || !bytes.Equal(got, data) {
+				t.Errorf("ReadFile() = wrong data, %v", err)
+			}
+		})
+	}
+}
+
+func TestSetFileTimestamp(t *testing.T) {
+	tests := []struct {
+		name    string
+		t       time.Time
+		want    time.Time
+		valid   bool
+		wantErr bool
+	}{
+		{"even seconds", time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC), time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC), true, false},
+		{"odd seconds", time.Date(2001, 2, 3, 4, 5, 7, 0, time.UTC), time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC), true, false},
+		{"nanoseconds", time.Date(1999, 12, 31, 23, 59, 59, 999, time.UTC), time.Date(1999, 12, 31, 23, 59, 58, 0, time.UTC), true, false},
+		{"other zone", time.Date(1990, 1, 1, 1, 0, 0, 0, time.FixedZone("CET", 3600)), time.Date(1990, 1, 1, 0, 0, 0, 0, time.UTC), true, false},
+		{"clear", time.Time{}, time.Time{}, false, false},
+		{"too late", time.Date(2028, 1, 1, 0, 0, 0, 0, time.UTC), testTime, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ti := newTestImage()
+			ti.addFile("Kernel.Mod", testData(100, 1), testTime)
+			fl := ti.open(t)
+			err := fl.SetFileTimestamp("Kernel.Mod", tt.t)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SetFileTimestamp() = %v, want error %v", err, tt.wantErr)
+			}
+
+			fds, err := ti.open(t).ListFiles()
+			if err != nil {
+				t.Fatalf("ListFiles: %v", err)
+			}
+			fd := fds[0]
+			if got := fd.ValidTimestamp(); got != tt.valid {
+				t.Fatalf("ValidTimestamp() = %v, want %v", got, tt.valid)
+			}
+			if tt.valid && !fd.Timestamp().Equal(tt.want) {
+				t.Errorf("Timestamp() = %v, want %v", fd.Timestamp(), tt.want)
+			}
+			if !tt.valid && (fd.date != 0 || fd.time != 0) {
+				t.Errorf("date and time = 0x%04x, 0x%04x, want 0", uint16(fd.date), uint16(fd.time))
+			}
+		})
+	}
+}
+
+func TestInitFAT(t *testing.T) {
+	// FAT entries 2 and 3 are packed into bytes 3-5: entry 2 is the first
+	// byte and the low nibble of the second one, entry 3 the high nibble of
+	// the second byte and the third byte.
+	tests := []struct {
+		packed     [3]byte
+		fat2, fat3 int32
+	}{
+		{[3]byte{0x03, 0x40, 0x00}, 3, 4},
+		{[3]byte{0x00, 0x00, 0x00}, 0, 0},
+		{[3]byte{0x34, 0x12, 0xab}, 0x234, 0xab1},
+		{[3]byte{0xff, 0xe7, 0xfe}, 0x7ff, 0xfee},
+		{[3]byte{0xef, 0xff, 0xef}, 0xfef, 0xeff},
+		{[3]byte{0xf0, 0x8f, 0xff}, -16, -8},
+		{[3]byte{0xf7, 0x0f, 0x00}, -9, 0},
+		{[3]byte{0x00, 0xf0, 0xff}, 0, -1},
+		{[3]byte{0xff, 0xff, 0xff}, -1, -1},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%x", tt.packed), func(t *testing.T) {
+			ti := newTestImage()
+			copy(ti.img[fatStartBlock*blockSize+3:], tt.packed[:])
+			fl := ti.open(t)
+			if fl.fat[2] != tt.fat2 || fl.fat[3] != tt.fat3 {
+				t.Errorf("FAT entries 2 and 3 = %d, %d, want %d, %d", fl.fat[2], fl.fat[3], tt.fat2, tt.fat3)
+			}
+			// The reserved entries are never blocks
+			if fl.fat[0] != -1 || fl.fat[1] != -1 {
+				t.Errorf("FAT entries 0 and 1 = %d, %d, want -1, -1", fl.fat[0], fl.fat[1])
+			}
+		})
+	}
+}
+
+func TestGetClusterReserved(t *testing.T) {
+	fl := newTestImage().open(t)
+	for _, i := range []int32{-9, -1, 0, 1} {
+		if _, err := fl.getCluster(i); err == nil {
+			t.Errorf("getCluster(%d) succeeded, want an error", i)
+		}
+	}
+}
+
+func TestVolumeLabelErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		first    byte // first byte of the label entry
+		attr     byte // byte 11 of the label entry
+		dirStart int32
+		wantErr  error
+	}{
+		{"valid", 0, 8, dirStartBlock, nil},
+		{"deleted marker", 0xe5, 8, dirStartBlock, nil},
+		{"no marker", 'T', 8, dirStartBlock, ErrNotOberon},
+		{"no label", 0, 0, dirStartBlock, ErrBadVolumeLabel},
+		{"no marker elsewhere", 'T', 8, 8, ErrNotOberon},
+		{"no label elsewhere", 0, 0, 8, ErrBadVolumeLabel},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ti := newTestImage()
+			label := ti.img[tt.dirStart*blockSize:]
+			label[0], label[11] = tt.first, tt.attr
+			fl := ti.open(t)
+			if err := fl.SetDirLocation(tt.dirStart, dirStartBlock+7); err != nil {
+				t.Fatalf("SetDirLocation: %v", err)
+			}
+			_, err := fl.ListFiles()
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ListFiles() = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), fmt.Sprintf("block %d", tt.dirStart)) {
+				t.Errorf("ListFiles() = %v, want an error naming block %d", err, tt.dirStart)
+			}
+		})
+	}
+}
+
+func TestFreeBlocks(t *testing.T) {
+	// A 720K floppy has 713 data blocks and room for 111 files
+	tests := []struct {
+		name      string
+		sizes     []int
+		wantUsed  int
+		wantFiles int
+	}{
+		{"empty", nil, 0, 0},
+		{"one block", []int{1}, 1, 1},
+		{"mixed", []int{0, 1024, 1025, 3000}, 1 + 1 + 2 + 3, 4},
+		{"full block", make([]int, 15), 15, 15},
+		{"two blocks", make([]int, 16), 16, 16},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ti := newTestImage()
+			for k, size := range tt.sizes {
+				ti.addFile(fmt.Sprintf("File%02d.Bin", k), testData(size, byte(k)), testTime)
+			}
+			fl := ti.open(t)
+			if got := fl.UsedBlocks(); got != tt.wantUsed {
+				t.Errorf("UsedBlocks() = %d, want %d", got, tt.wantUsed)
+			}
+			if got := fl.FreeBlocks(); got != 713-tt.wantUsed {
+				t.Errorf("FreeBlocks() = %d, want %d", got, 713-tt.wantUsed)
+			}
+			got, err := fl.FreeDirEntries()
+			if err != nil || got != 111-tt.wantFiles {
+				t.Errorf("FreeDirEntries() = %d, %v, want %d", got, err, 111-tt.wantFiles)
+			}
+		})
+	}
+}
+
+func TestListFilesZeroBlock(t *testing.T) {
+	// Block 7 is full: the volume label and 15 files. Block 8 is all zeros,
+	// the blocks after it hold garbage that must not be read as entries.
+	tests := []struct {
+		name    string
+		garbage byte
+	}{
+		{"zeros", 0},
+		{"letters", 'A'},
+		{"deleted markers", 0xe5},
+		{"ones", 0xff},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ti := newTestImage()
+			for k := 0; k < 15; k++ {
+				ti.addFile(fmt.Sprintf("File%02d.Text", k), testData(10, byte(k)), testTime)
+			}
+			dir := ti.img[(dirStartBlock+2)*blockSize : dataStartBlock*blockSize]
+			for i := range dir {
+				dir[i] = tt.garbage
+			}
+			fl := ti.open(t)
+			fds, err := fl.ListFiles()
+			if err != nil {
+				t.Fatalf("ListFiles: %v", err)
+			}
+			if len(fds) != 15 || fds[14].Name() != "File14.Text" {
+				t.Fatalf("ListFiles returned %d files, want File00.Text to File14.Text", len(fds))
+			}
+			free, err := fl.FreeDirEntries()
+			if err != nil || free != fl.MaxFiles()-15 {
+				t.Errorf("FreeDirEntries() = %d, %v, want %d", free, err, fl.MaxFiles()-15)
+			}
+			deleted, err := fl.ListDeletedFiles()
+			if err != nil || len(deleted) != 0 {
+				t.Errorf("ListDeletedFiles() = %d files, %v, want none", len(deleted), err)
+			}
+		})
+	}
+}
+
+func TestSizeChainMismatch(t *testing.T) {
+	// The file's chain has 3 blocks, which hold 3072 bytes
+	data := testData(3*testClusterSize, 1)
+	tests := []struct {
+		name     string
+		size     int32
+		wantData int  // bytes returned by ReadFile
+		wantErr  bool // ReadFile fails
+	}{
+		{"shorter", 100, 100, false},
+		{"exact", 3072, 3072, false},
+		{"one byte more", 3073, 3072, true},
+		{"longer", 5000, 3072, true},
+		{"larger than the floppy", 1 << 20, 3072, true},
+		{"negative", -1, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ti := newTestImage()
+			ti.addFile("Kernel.Mod", data, testTime)
+			ti.setSize(0, tt.size)
+			fl := ti.open(t)
+			fds, err := fl.ListFiles()
+			if err != nil {
+				t.Fatalf("ListFiles: %v", err)
+			}
+			fd := fds[0]
+
+			got, readErr := fl.ReadFile(fd)
+			if (readErr != nil) != tt.wantErr {
+				t.Fatalf("ReadFile() = %v, want error %v", readErr, tt.wantErr)
+			}
+			if readErr != nil && tt.size > 0 && !errors.Is(readErr, ErrTruncated) {
+				t.Errorf("ReadFile() = %v, want %v", readErr, ErrTruncated)
+			}
+			if !bytes.Equal(got, data[:tt.wantData]) {
+				t.Errorf("ReadFile returned %d bytes, want the first %d", len(got), tt.wantData)
+			}
+
+			r, err := fl.Open(fd)
+			if tt.size < 0 {
+				if err == nil {
+					t.Errorf("Open() succeeded, want an error")
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("Open: %v", err)
+				}
+				got, err = io.ReadAll(r)
+				if (err != nil) != tt.wantErr || !bytes.Equal(got, data[:tt.wantData]) {
+					t.Errorf("reading via Open returned %d bytes, %v, want %d bytes, error %v", len(got), err, tt.wantData, tt.wantErr)
+				}
+				// Both ways of reading report a broken chain alike
+				if fmt.Sprint(err) != fmt.Sprint(readErr) {
+					t.Errorf("reading via Open failed with %v, ReadFile with %v", err, readErr)
+				}
+			}
+
+			// The blocks are in use, so the file can't be recovered as a
+			// deleted one
+			if fl.Recoverable(fd) {
+				t.Errorf("Recoverable() = true, want false")
+			}
+			if _, err := fl.RecoverFile(fd); tt.size < 0 && err == nil {
+				t.Errorf("RecoverFile() succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestStoreFATCopies(t *testing.T) {
+	fatBytes := fatBlockCount * blockSize
+	tests := []struct {
+		name     string
+		dirStart int32
+		copied   bool // the second copy in blocks 4-6 is written
+	}{
+		{"default", dirStartBlock, true},
+		{"directory moved over the copy", 4, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ti := newTestImage()
+			ti.addFile("Kernel.Mod", testData(3000, 1), testTime)
+			fl := ti.open(t)
+			if err := fl.SetDirLocation(tt.dirStart, tt.dirStart+7); err != nil {
+				t.Fatalf("SetDirLocation: %v", err)
+			}
+			if tt.dirStart != dirStartBlock {
+				copy(ti.img[tt.dirStart*blockSize:], ti.img[dirStartBlock*blockSize:dirEndBlock*blockSize])
+			}
+			if err := fl.AddFile("Oberon.Text", testData(100, 2), testTime); err != nil {
+				t.Fatalf("AddFile: %v", err)
+			}
+			if err := fl.RemoveFile("Kernel.Mod"); err != nil {
+				t.Fatalf("RemoveFile: %v", err)
+			}
+			first := ti.img[fatStartBlock*blockSize:][:fatBytes]
+			second := ti.img[(fatStartBlock+fatBlockCount)*blockSize:][:fatBytes]
+			if got := bytes.Equal(first, second); got != tt.copied {
+				t.Errorf("FAT copies equal = %v, want %v", got, tt.copied)
+			}
+			fds, err := fl.ListFiles()
+			if err != nil || len(fds) != 1 || fds[0].Name() != "Oberon.Text" {
+				t.Errorf("ListFiles() = %v, %v, want only Oberon.Text", fds, err)
+			}
+		})
+	}
+}
+
+func TestFreeDirEntriesDOS(t *testing.T) {
+	// The root directory of a 720K MS-DOS floppy has 112 entries
+	const (
+		label   = "LABEL      \x08"
+		file    = "FILE    TXT\x20"
+		deleted = "\xe5ILE    TXT\x20"
+		subdir  = "SUBDIR     \x10"
+	)
+	tests := []struct {
+		name    string
+		entries []string
+		want    int
+	}{
+		{"empty", nil, 112},
+		{"label and files", []string{label, file, file}, 109},
+		{"deleted", []string{label, deleted, file}, 110},
+		{"subdirectory", []string{subdir, file}, 110},
+		{"garbage after the end", []string{file, "", file}, 111},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img := make([]byte, 1440*blockSize)
+			img[0], img[11], img[12] = 0xeb, 0x00, 0x02 // jump, 512 bytes per sector
+			img[21] = 0xf9
+			for k, e := range tt.entries {
+				copy(img[dirStartBlock*blockSize+k*fileDescSize:], e)
+			}
+			fl, err := OpenBytes(img)
+			if err != nil {
+				t.Fatalf("OpenBytes: %v", err)
+			}
+			if !fl.IsDOS() {
+				t.Fatalf("IsDOS() = false, want true")
+			}
+			if got := fl.MaxFiles(); got != 112 {
+				t.Errorf("MaxFiles() = %d, want 112", got)
+			}
+			got, err := fl.FreeDirEntries()
+			if err != nil || got != tt.want {
+				t.Errorf("FreeDirEntries() = %d, %v, want %d", got, err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+/*
+ * Copyright (c) 2023 Andreas Signer <asigner@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by the
+ * Free Software Foundation, either version 3 of the License, or (at your
+ * option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+ * for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package oberon
+
+import (
+	"fmt"
+	"io"
+)
+
+// fileReader reads a file block by block, following its FAT chain.
+type fileReader struct {
+	fl        *Floppy
+	size      int32 // size of the file
+	next      int32 // FAT block to read next
+	remaining int32 // bytes not read from the floppy yet
+	buf       []byte
+	visited   map[int32]bool
+	err       error // returned once buf has been read
+}
+
+// Open returns a reader for the contents of the file described by fd. The
+// blocks are only read when needed, so unlike ReadFile, the file is never
+// held in memory completely.
+func (fl *Floppy) Open(fd FileDesc) (io.ReadCloser, error) {
+	if fd.size < 0 {
+		return nil, fmt.Errorf("invalid file size %d", fd.size)
+	}
+	return &fileReader{
+		fl:        fl,
+		size:      fd.size,
+		next:      int32(fd.head),
+		remaining: fd.size,
+		visited:   make(map[int32]bool),
+	}, nil
+}
+
+func (r *fileReader) Read(p []byte) (int, error) {
+	if len(r.buf) == 0 {
+		if err := r.readBlock(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// readBlock reads the next block of the file into buf, and advances to the
+// following one. The checks and the errors are the same as in readFile.
+func (r *fileReader) readBlock() error {
+	if r.err != nil {
+		return r.err
+	}
+	if r.remaining == 0 {
+		return io.EOF
+	}
+	i := r.next
+	if r.visited[i] {
+		return r.truncated(fmt.Errorf("FAT cycle detected starting at block %d", i))
+	}
+	r.visited[i] = true
+	logger.Printf("reading block %d, %d bytes remaining", i, r.remaining)
+	buf, err := r.fl.getCluster(i)
+	if err != nil {
+		return r.truncated(err)
+	}
+	n := min(r.remaining, int32(len(buf)))
+	r.buf = buf[:n]
+	r.remaining -= n
+	if r.remaining > 0 {
+		// The block read is returned before a broken chain is reported
+		if r.next, err = r.fl.nextInChain(i); err != nil {
+			r.err = r.truncated(err)
+		}
+	}
+	return nil
+}
+
+// truncated wraps err like readFile does: once a part of the file has been
+// read, the error wraps ErrTruncated.
+func (r *fileReader) truncated(err error) error {
+	read := r.size - r.remaining
+	if read == 0 {
+		return err
+	}
+	return truncated(int(read), r.size, err)
+}
+
+func (r *fileReader) Close() error {
+	return nil
+}
@@ -0,0 +1,107 @@
+/*
+ * Copyright (c) 2023 Andreas Signer <asigner@gmail.com>
+ *
+ * This program is free software: you can redistribute it and/or modify it
+ * under the terms of the GNU General Public License as published by the
+ * Free Software Foundation, either version 3 of the License, or (at your
+ * option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+ * for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package oberon
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// oberonChars maps the non-ASCII characters of the Oberon character set
+// to Unicode.
+var oberonChars = map[byte]rune{
+	0x80: 'Ä', 0x81: 'Ö', 0x82: 'Ü',
+	0x83: 'ä', 0x84: 'ö', 0x85: 'ü',
+	0x86: 'â', 0x87: 'ê', 0x88: 'î', 0x89: 'ô', 0x8a: 'û',
+	0x8b: 'à', 0x8c: 'è', 0x8d: 'ì', 0x8e: 'ò', 0x8f: 'ù',
+	0x90: 'é', 0x91: 'ë', 0x92: 'ï', 0x93: 'ç',
+	0x94: 'á', 0x95: 'ñ', 0x96: 'ß',
+}
+
+// TextToUTF8 converts text in the Oberon character set to UTF-8. Lines
+// end with CR in Oberon, they are converted to LF. Bytes that have no
+// equivalent are replaced with U+FFFD.
+func TextToUTF8(data []byte) []byte {
+	res, _ := ConvertText(data)
+	return res
+}
+
+// TextStats counts the changes made when converting text to UTF-8, which
+// helps telling whether the data really was text.
+type TextStats struct {
+	LineEnds   int // CRs converted to LF
+	Translated int // non-ASCII characters translated to UTF-8
+	Replaced   int // bytes without an equivalent, replaced with U+FFFD
+}
+
+// ConvertText is like TextToUTF8, but also returns what was changed.
+func ConvertText(data []byte) ([]byte, TextStats) {
+	var stats TextStats
+	res := make([]byte, 0, len(data))
+	for _, b := range data {
+		switch {
+		case b == '\r':
+			res = append(res, '\n')
+			stats.LineEnds++
+		case b < 0x80:
+			res = append(res, b)
+		default:
+			r, found := oberonChars[b]
+			if found {
+				stats.Translated++
+			} else {
+				r = utf8.RuneError
+				stats.Replaced++
+			}
+			res = utf8.AppendRune(res, r)
+		}
+	}
+	return res, stats
+}
+
+// DisplayName returns the file's name in a form that is safe to print:
+// The non-ASCII characters of the Oberon character set are converted to
+// UTF-8, and all other bytes that can't be printed are escaped as \xNN.
+// Use Name to match names exactly.
+func (fd *FileDesc) DisplayName() string {
+	var sb strings.Builder
+	for _, b := range []byte(fd.Name()) {
+		r, found := oberonChars[b]
+		switch {
+		case b >= 0x20 && b < 0x7f:
+			sb.WriteByte(b)
+		case found:
+			sb.WriteRune(r)
+		default:
+			fmt.Fprintf(&sb, "\\x%02x", b)
+		}
+	}
+	return sb.String()
+}
+
+// PrintableName reports whether the file's name only consists of
+// printable characters. Names that don't often belong to corrupt entries.
+func (fd *FileDesc) PrintableName() bool {
+	for _, b := range []byte(fd.Name()) {
+		if _, found := oberonChars[b]; !found && (b < 0x20 || b >= 0x7f) {
+			return false
+		}
+	}
+	return true
+}